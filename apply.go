@@ -0,0 +1,46 @@
+package goru
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// CheckClean makes sure the git checkout in dir has no changes, so the
+// diffs ApplyTo gets are the only ones in it.
+func CheckClean(ctx context.Context, r Runner, dir string) error {
+	out, err := r.Run(ctx, dir, "git", "status", "--porcelain")
+	if err != nil {
+		return fmt.Errorf("%s isn't a git checkout: %s\n%s", dir, err, out)
+	}
+	if len(bytes.TrimSpace(out)) > 0 {
+		return fmt.Errorf("%s has uncommitted changes:\n%s", dir, out)
+	}
+	return nil
+}
+
+// applyDiff applies the arch's diff in outDir to the checkout in
+// ApplyTo, leaving the checkout alone if any of it doesn't apply.
+func (c *Config) applyDiff(ctx context.Context, outDir, arch string) error {
+	diff, err := filepath.Abs(filepath.Join(outDir, DiffName(arch)))
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(diff); err != nil {
+		return err
+	} else if fi.Size() == 0 {
+		slog.Info("empty diff, nothing to apply", "arch", arch)
+		return nil
+	}
+	if out, err := c.Runner.Run(ctx, c.ApplyTo, "git", "apply", "--check", diff); err != nil {
+		return fmt.Errorf("%s diff doesn't apply to %s: %s\n%s", arch, c.ApplyTo, err, out)
+	}
+	if out, err := c.Runner.Run(ctx, c.ApplyTo, "git", "apply", diff); err != nil {
+		return fmt.Errorf("applying the %s diff to %s: %s\n%s", arch, c.ApplyTo, err, out)
+	}
+	slog.Info("applied the diff", "arch", arch, "checkout", c.ApplyTo)
+	return nil
+}
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/qbit/goru"
+)
+
+// stringList is a flag.Value that collects every use of a flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// commaList is a flag.Value that accepts repeated or comma separated
+// values.
+type commaList []string
+
+func (m *commaList) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *commaList) Set(v string) error {
+	for _, u := range strings.Split(v, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			*m = append(*m, u)
+		}
+	}
+	return nil
+}
+
+// releaseRE matches numbered releases, like 7.5.
+var releaseRE = regexp.MustCompile(`^\d+\.\d+$`)
+
+// commands are the subcommands and the stages each runs.
+var commands = map[string][]string{
+	"fetch":   {"fetch"},
+	"verify":  {"verify"},
+	"install": {"install"},
+	"run":     {"run"},
+	"build":   {"build"},
+	"all":     {"fetch", "verify", "build"},
+}
+
+func usage() {
+	fmt.Println("usage: goru [flags] [fetch | verify | install | run | build | all] release")
+	fmt.Println("       goru [flags] selftest")
+	fmt.Println("       goru [flags] -yes clean release")
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func main() {
+	cfg := &goru.Config{}
+	var arches commaList
+	flag.Var(&arches, "arch",
+		"arch to build; repeat or comma separate for several, defaults to all")
+	yes := flag.Bool("yes", false,
+		"let clean delete the directories it lists")
+	jsonOut := flag.Bool("json", false,
+		"print the end of run summary as JSON")
+	flag.StringVar(&cfg.ApplyTo, "apply", "",
+		"git checkout of golang.org/x/sys to apply each arch's diff to once it's built; it must have no uncommitted changes")
+	combined := flag.Bool("combined", false,
+		"after building, put the diffs of every arch that succeeded in one "+goru.CombinedDiff+" in the release's directory")
+	destDir := flag.String("dest", "/tmp/openbsd",
+		"directory releases are fetched and built in")
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	flag.IntVar(&cfg.Port, "port", goru.DefaultPort,
+		"port to serve the sets and install files to the guest on, 0 for any free one")
+	flag.StringVar(&cfg.BindAddr, "bind-addr", "127.0.0.1",
+		"address to serve the guest on; tap or bridged guests need one they can reach, like 0.0.0.0")
+	flag.StringVar(&cfg.HostAddr, "host-addr", "10.0.2.2",
+		"address the guest reaches the host on, qemu's user networking gateway by default")
+	flag.StringVar(&cfg.CacheDir, "cache-dir", path.Join(cacheDir, "goru"),
+		"directory signify keys missing from /etc/signify are cached in")
+	flag.BoolVar(&cfg.GuestVerify, "guest-verify", false,
+		"also have the installer verify the sets, serving it SHA256.sig and refusing to continue without it")
+	flag.BoolVar(&cfg.StrictVerify, "strict-verify", false,
+		"fail unless every non-optional set is present and verified")
+	flag.BoolVar(&cfg.SHA256Only, "sha256-only", false,
+		"verify the sets against SHA256 without signify; SHA256 comes from the same mirror, so this only catches corrupt downloads")
+	flag.BoolVar(&cfg.Verbose, "verbose", false,
+		"print the full qemu command line before running it")
+	flag.BoolVar(&cfg.DryRun, "dry-run", false,
+		"print the downloads, commands and install files without fetching or running anything")
+	flag.BoolVar(&cfg.KeepDisk, "keep-disk", false,
+		"boot an existing installed disk image instead of reinstalling")
+	flag.BoolVar(&cfg.Snapshot, "snapshot", false,
+		"boot the existing installed disk with qemu's -snapshot, leaving it untouched")
+	flag.BoolVar(&cfg.BaseImage, "base-image", false,
+		"install once into base.<format> and boot every later build from a throwaway qcow2 overlay of it")
+	flag.IntVar(&cfg.DiskSize, "disk-size", goru.DefaultDiskSize,
+		"size of each guest's disk in megabytes")
+	flag.StringVar(&cfg.DiskFormat, "disk-format", "raw",
+		"format of the guest's disk image: raw, which is preallocated, or qcow2")
+	layoutFile := flag.String("disklabel", "",
+		"autopartitioning template for the guest's disk, defaults to a 5G+ / and 1G swap")
+	flag.BoolVar(&cfg.NoAccel, "no-accel", false,
+		"emulate every guest, even ones KVM or HVF could run natively")
+	flag.BoolVar(&cfg.Virtio, "virtio", false,
+		"give the amd64, i386 and arm64 guests a virtio NIC and disk, vio0 and sd0, instead of e1000 and IDE")
+	flag.Var((*stringList)(&cfg.QemuArgs), "qemu-arg",
+		"argument appended verbatim to every qemu command line; repeat for several, one argument each")
+	flag.BoolVar(&cfg.RNG, "rng", false,
+		"give the guest a virtio-rng device backed by the host's /dev/urandom")
+	cfg.BIOS = map[string]*string{}
+	cfg.Kernel = map[string]*string{}
+	cfg.Disk = map[string]*string{}
+	cfg.Mem = map[string]*int{}
+	cfg.CPUs = map[string]*int{}
+	for arch, q := range goru.QemuArches {
+		cfg.Mem[arch] = flag.Int(arch+"-mem", q.MemMB,
+			fmt.Sprintf("megabytes of memory for the %s guest", arch))
+		cfg.CPUs[arch] = flag.Int(arch+"-cpus", q.CPUs,
+			fmt.Sprintf("number of CPUs for the %s guest", arch))
+		cfg.Disk[arch] = flag.String(arch+"-disk", "",
+			fmt.Sprintf("disk the %s guest installs to (default %s)", arch, q.Disk))
+		if len(q.BIOS) > 0 {
+			cfg.BIOS[arch] = flag.String(arch+"-bios", "",
+				fmt.Sprintf("firmware for the %s guest, searched for if unset", arch))
+		}
+		if len(q.Kernel) > 0 {
+			cfg.Kernel[arch] = flag.String(arch+"-kernel", "",
+				fmt.Sprintf("boot loader for the %s guest, searched for if unset", arch))
+		}
+	}
+	flag.StringVar(&cfg.Timezone, "timezone", "UTC",
+		"timezone the guest is installed with")
+	flag.BoolVar(&cfg.SSHD, "sshd", true,
+		"start sshd in the guest")
+	flag.StringVar(&cfg.RootSSH, "root-ssh", "no",
+		"allow root ssh login in the guest: yes, no or prohibit-password")
+	flag.IntVar(&cfg.SSHPort, "ssh-port", 0,
+		"localhost port to forward to the guest's sshd, 0 for none")
+	flag.StringVar(&cfg.Transport, "transport", "http",
+		"how the diff gets back from the guest: http, posted with curl, or ssh, which needs -ssh-key and -ssh-port")
+	flag.StringVar(&cfg.Locale, "locale", "",
+		"LC_ALL to export in the guest before building")
+	flag.BoolVar(&cfg.Force, "force", false,
+		"download every set again, even ones already in -dest")
+	flag.BoolVar(&cfg.Conditional, "conditional", false,
+		"check sets already in -dest against the mirror's ETag or Last-Modified, always on for snapshots")
+	flag.IntVar(&cfg.Jobs, "jobs", 4,
+		"number of sets to download at once")
+	flag.IntVar(&cfg.Retries, "retries", 3,
+		"number of attempts for each download")
+	flag.DurationVar(&cfg.RetryDelay, "retry-delay", time.Second,
+		"delay before the first download retry, doubled for each one after")
+	maxConns := flag.Int("max-conns-per-host", 2,
+		"maximum number of connections to open to each mirror")
+	rateLimit := flag.Int("rate-limit", 0,
+		"bytes per second all downloads together are kept under, 0 for no limit")
+	httpTimeout := flag.Duration("http-timeout", 2*time.Minute,
+		"give up on a request to a mirror when it sends nothing for this long and retry it; 0 for no limit")
+	flag.Var((*commaList)(&cfg.Mirrors), "mirror",
+		"mirror URL with %s placeholders for the release, arch and file, in that order; repeat or comma separate to fail over")
+	cfg.Guest = goru.DefaultGuest
+	flag.StringVar(&cfg.Guest.Hostname, "hostname", cfg.Guest.Hostname,
+		"hostname of the guest")
+	flag.StringVar(&cfg.Guest.User, "user", cfg.Guest.User,
+		"user the recipe runs as in the guest")
+	flag.StringVar(&cfg.Guest.FullName, "full-name", cfg.Guest.FullName,
+		"full name of the guest user")
+	flag.StringVar(&cfg.Guest.UserPass, "user-pass", cfg.Guest.UserPass,
+		"password of the guest user")
+	flag.StringVar(&cfg.Guest.RootPass, "root-pass", cfg.Guest.RootPass,
+		"root password of the guest")
+	sshKey := flag.String("ssh-key", "",
+		"public key file to authorize for the guest user, for logging in to debug a build; -transport ssh uses the private key next to it")
+	flag.StringVar(&cfg.Prompts.Boot, "boot-prompt", "",
+		"regexp for the boot loader's prompt (default boot>)")
+	flag.StringVar(&cfg.Prompts.Login, "login-prompt", "",
+		"regexp for the guest's login prompt (default login:)")
+	flag.StringVar(&cfg.Prompts.Root, "root-prompt", "",
+		"regexp for root's shell prompt in the guest (default the hostname then #)")
+	flag.StringVar(&cfg.Prompts.User, "user-prompt", "",
+		"regexp for the guest user's shell prompt (default the hostname then $)")
+	flag.StringVar(&cfg.Guest.Sets, "install-sets", cfg.Guest.Sets,
+		"answer to the installer's set selection")
+	flag.Var((*commaList)(&cfg.Packages), "packages",
+		"packages to pkg_add in the guest; repeat or comma separate (default bash,git,go)")
+	var optional commaList
+	flag.Var(&optional, "optional",
+		"sets that may be missing from a mirror; repeat or comma separate (default bsd.mp)")
+	flag.DurationVar(&cfg.BootTimeout, "boot-timeout", 5*time.Minute,
+		"how long to wait for each prompt while the guest boots")
+	flag.DurationVar(&cfg.InstallTimeout, "install-timeout", 30*time.Minute,
+		"how long to wait for the autoinstall to finish once it starts")
+	flag.IntVar(&cfg.BootRetries, "boot-retries", 2,
+		"times to retry an arch on a fresh disk when the guest hangs booting")
+	flag.Var((*stringList)(&cfg.BootCmds), "boot-cmds",
+		"command to run at the boot> prompt before booting; may be repeated")
+	timeout := flag.Duration("timeout", 0,
+		"stop the whole run after this long, 0 for no limit")
+	osName := flag.String("os", "openbsd",
+		"OS to build in: openbsd or netbsd")
+	flag.StringVar(&goru.NetBSDMirror, "netbsd-mirror", goru.NetBSDMirror,
+		"NetBSD mirror URL with %s placeholders for the release, port and file, in that order")
+	configFile := flag.String("config", "",
+		"JSON file listing the arches to build and how qemu runs them, replacing the built-in ones")
+	recipeFile := flag.String("recipe", "",
+		"JSON recipe for the work done in the guest, defaults to regenerating x/sys/unix")
+	repo := flag.String("repo", "",
+		"git repository to clone in the guest, overriding the recipe's")
+	ref := flag.String("ref", "",
+		"branch, tag or commit of the repository to build, overriding the recipe's")
+	dir := flag.String("dir", "",
+		"directory of the clone to build in, overriding the recipe's")
+	diffFD := flag.Int("diff-fd", -1,
+		"file descriptor to write each received diff to")
+	flag.StringVar(&cfg.DiffPipe, "diff-pipe", "",
+		"named pipe to write each received diff to; diffs are skipped while nothing reads it")
+	logLevel := flag.String("log-level", "info",
+		"least severe logs to show: debug, info, warn or error")
+	logJSON := flag.Bool("log-json", false,
+		"write logs as JSON")
+	useSyslog := flag.Bool("syslog", false,
+		"also send logs to syslog")
+	syslogConsole := flag.Bool("syslog-console", false,
+		"with -syslog, also send the guest console to syslog")
+	flag.BoolVar(&cfg.ConsoleLog, "console-log", false,
+		"also write each arch's guest console to console.log in its directory")
+	flag.StringVar(&cfg.OnSuccess, "on-success", "",
+		"shell command to run on the host after an arch builds")
+	flag.StringVar(&cfg.OnFailure, "on-failure", "",
+		"shell command to run on the host after an arch fails")
+	flag.Usage = usage
+	flag.Parse()
+
+	if cfg.Jobs < 1 {
+		log.Fatal("-jobs must be at least 1")
+	}
+	// Only flags given on the command line override -config.
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for arch := range goru.QemuArches {
+		if *cfg.Mem[arch] < 1 || *cfg.CPUs[arch] < 1 {
+			log.Fatalf("-%s-mem and -%s-cpus must be at least 1", arch, arch)
+		}
+		if !given[arch+"-mem"] {
+			delete(cfg.Mem, arch)
+		}
+		if !given[arch+"-cpus"] {
+			delete(cfg.CPUs, arch)
+		}
+	}
+
+	if cfg.Snapshot && cfg.BaseImage {
+		log.Fatal("-snapshot and -base-image both keep the installed disk as it is, use one")
+	}
+	if cfg.StrictVerify && cfg.SHA256Only {
+		log.Fatal("-strict-verify needs signify, it can't be used with -sha256-only")
+	}
+
+	if cfg.DiskFormat != "raw" && cfg.DiskFormat != "qcow2" {
+		log.Fatalf("invalid -disk-format %q", cfg.DiskFormat)
+	}
+
+	cfg.DiskLayout = goru.DefaultDiskLayout
+	if *layoutFile != "" {
+		b, err := os.ReadFile(*layoutFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.DiskLayout = string(b)
+	}
+	need, err := goru.LayoutMinimum(cfg.DiskLayout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if need > int64(cfg.DiskSize)<<20 {
+		log.Fatalf("the disklabel template needs at least %dM, more than -disk-size %dM",
+			need>>20, cfg.DiskSize)
+	}
+
+	if cfg.Retries < 1 {
+		log.Fatal("-retries must be at least 1")
+	}
+
+	switch cfg.RootSSH {
+	case "yes", "no", "prohibit-password":
+	default:
+		log.Fatalf("invalid -root-ssh %q", cfg.RootSSH)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Fatalf("invalid -log-level %q", *logLevel)
+	}
+	logOpts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, logOpts)
+	if *logJSON {
+		handler = slog.NewJSONHandler(os.Stderr, logOpts)
+	}
+	var logOut io.Writer = os.Stderr
+	if *useSyslog {
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "goru")
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = teeHandler{handler, newSyslogHandler(w, level)}
+		logOut = io.MultiWriter(os.Stderr, syslogErrors{w})
+		if *syslogConsole {
+			cfg.Console = syslogLines(w)
+		}
+	}
+	slog.SetDefault(slog.New(handler))
+	// SetDefault sends the log package through slog at info level,
+	// which fatal errors aren't.
+	log.SetOutput(logOut)
+	log.SetFlags(log.LstdFlags)
+
+	cfg.Token, err = goru.NewToken()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg.Progress = os.Stdout
+	cfg.Output = os.Stdout
+	cfg.Runner = goru.ExecRunner{}
+
+	cfg.Client = goru.NewClient(*httpTimeout, *maxConns)
+	if *rateLimit > 0 {
+		cfg.Limiter = goru.NewLimiter(*rateLimit)
+	}
+
+	cfg.Recipe = goru.SysRecipe
+	if *recipeFile != "" {
+		cfg.Recipe, err = goru.LoadRecipe(*recipeFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *repo != "" {
+		cfg.Recipe.Repo = *repo
+	}
+	if *ref != "" {
+		cfg.Recipe.Ref = *ref
+	}
+	if *dir != "" {
+		cfg.Recipe.Dir = *dir
+	}
+
+	if *diffFD >= 0 {
+		cfg.DiffFile = os.NewFile(uintptr(*diffFD), "diff-fd")
+	}
+
+	if len(cfg.Mirrors) == 0 {
+		cfg.Mirrors = []string{goru.DefaultMirror}
+	}
+	for _, m := range cfg.Mirrors {
+		if err := goru.CheckMirror(m); err != nil {
+			log.Fatalf("invalid -mirror %q: %s", m, err)
+		}
+	}
+	// The hostname and user are typed and matched in the guest's
+	// shell.
+	for _, v := range []string{cfg.Guest.Hostname, cfg.Guest.User} {
+		if v == "" || strings.Trim(v, goru.ShellSafe) != "" {
+			log.Fatalf("invalid -hostname or -user %q", v)
+		}
+	}
+
+	for _, re := range []string{cfg.Prompts.Boot, cfg.Prompts.Login, cfg.Prompts.Root, cfg.Prompts.User} {
+		if _, err := regexp.Compile(re); err != nil {
+			log.Fatalf("invalid prompt %q: %s", re, err)
+		}
+	}
+
+	if *sshKey != "" {
+		b, err := os.ReadFile(*sshKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.Guest.SSHKey, err = goru.ParseSSHKey(b)
+		if err != nil {
+			log.Fatalf("invalid -ssh-key %q: %s", *sshKey, err)
+		}
+	}
+	switch cfg.Transport {
+	case "http":
+	case "ssh":
+		if *sshKey == "" || cfg.SSHPort <= 0 || !cfg.SSHD {
+			log.Fatal("-transport ssh needs -ssh-key, -ssh-port and -sshd")
+		}
+		cfg.SSHSigner, err = goru.LoadSSHSigner(strings.TrimSuffix(*sshKey, ".pub"), cfg.Guest.SSHKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("invalid -transport %q", cfg.Transport)
+	}
+
+	if len(cfg.Packages) == 0 {
+		cfg.Packages = goru.DefaultPackages
+	}
+	for _, p := range cfg.Packages {
+		// These end up on the guest's command line.
+		if strings.Trim(p, goru.ShellSafe) != "" || strings.HasPrefix(p, "-") {
+			log.Fatalf("invalid package name %q", p)
+		}
+	}
+	if len(optional) == 0 {
+		optional = commaList(goru.DefaultOptional)
+	}
+	cfg.Optional = make(map[string]bool)
+	for _, file := range optional {
+		cfg.Optional[file] = true
+	}
+
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		usage()
+	}
+
+	cfg.Stages = map[string]bool{}
+	if flag.Arg(0) == "selftest" {
+		for _, s := range commands["all"] {
+			cfg.Stages[s] = true
+		}
+		slog.Info("running self test")
+		sets, err := selectSets(cfg, *osName, *configFile, arches, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := goru.SelfTest(sets); err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("self test passed")
+		return
+	}
+
+	command, release := "all", flag.Arg(0)
+	if flag.NArg() == 2 {
+		command, release = flag.Arg(0), flag.Arg(1)
+	}
+	if !releaseRE.MatchString(release) && release != "snapshots" {
+		fmt.Fprintf(os.Stderr, "invalid release %q, expected something like 7.5 or snapshots\n", release)
+		usage()
+	}
+	if command == "clean" {
+		if err := clean(path.Join(*destDir, release), arches, *yes); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	stages, ok := commands[command]
+	if !ok {
+		usage()
+	}
+	for _, s := range stages {
+		cfg.Stages[s] = true
+	}
+	// install always makes a new disk, which -snapshot would throw
+	// away and -keep-disk is asking not to.
+	if cfg.Stages["install"] && (cfg.Snapshot || cfg.KeepDisk) {
+		log.Fatal("-snapshot and -keep-disk boot an installed disk, use them with run or build, not install")
+	}
+	smushVer := strings.ReplaceAll(release, ".", "")
+
+	// Interrupting the run or reaching -timeout stops the current
+	// arch, which kills its qemu and server on the way out.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	if release == "snapshots" && *osName != "openbsd" {
+		log.Fatal("snapshots are only supported for OpenBSD")
+	}
+	if release == "snapshots" {
+		arch := "amd64"
+		if len(arches) > 0 {
+			arch = arches[0]
+		}
+		if cfg.DryRun {
+			// Finding the version means asking the mirror, which a
+			// dry run doesn't do.
+			smushVer = "NN"
+		} else {
+			smushVer, err = goru.SnapshotVersion(ctx, cfg, arch)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		// Snapshots are rebuilt in place, so sets already on disk
+		// are only kept if the mirror says they haven't changed.
+		cfg.Conditional = true
+		slog.Info("building snapshots", "version", smushVer)
+	}
+
+	dest := path.Join(*destDir, release)
+	if !cfg.DryRun {
+		err = os.MkdirAll(dest, 0750)
+		if err != nil && !os.IsExist(err) {
+			log.Fatal(err)
+		}
+		if err := checkWritable(dest); err != nil {
+			log.Fatalf("destination %q isn't writable: %s", dest, err)
+		}
+	}
+
+	sets, err := selectSets(cfg, *osName, *configFile, arches, smushVer)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if missing := goru.MissingTools(sets.RequiredTools()); len(missing) > 0 && !cfg.DryRun {
+		log.Fatalf("missing required tools: %s", strings.Join(missing, ", "))
+	}
+
+	if cfg.ApplyTo != "" && !cfg.DryRun {
+		if err := goru.CheckClean(ctx, cfg.Runner, cfg.ApplyTo); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var res goru.Results
+	for _, set := range sets {
+		r := goru.RunArch(ctx, cfg, set, dest, release, smushVer)
+		res = append(res, r)
+		if ctx.Err() != nil {
+			slog.Warn("stopping, skipping the remaining arches", "arch", set.Arch(), "err", ctx.Err())
+			break
+		}
+
+		status, hook := "success", cfg.OnSuccess
+		if !r.OK() {
+			status, hook = "failure", cfg.OnFailure
+		}
+		if hook != "" && !cfg.DryRun {
+			diffPath := path.Join(dest, set.Arch(), goru.DiffName(set.Arch()))
+			if hErr := runHook(hook, set.Arch(), release, diffPath, status); hErr != nil {
+				slog.Error("hook failed", "arch", set.Arch(), "status", status, "err", hErr)
+			}
+		}
+
+		duration := time.Duration(r.Seconds * float64(time.Second)).Round(time.Second)
+		if !r.OK() {
+			slog.Error("arch failed", "arch", set.Arch(), "stage", r.Stage,
+				"duration", duration, "err", r.Error)
+		} else if r.Diff != nil && r.Diff.Empty {
+			slog.Warn("arch done with an empty diff", "arch", set.Arch(), "duration", duration)
+		} else if r.Diff != nil {
+			slog.Info("arch done", "arch", set.Arch(), "duration", duration, "diff", r.Diff)
+		} else {
+			slog.Info("arch done", "arch", set.Arch(), "duration", duration)
+		}
+	}
+
+	if *combined && !cfg.DryRun && (cfg.Stages["build"] || cfg.Stages["run"]) {
+		included, err := res.WriteCombined(dest)
+		switch {
+		case err != nil:
+			slog.Error("couldn't combine the diffs", "err", err)
+		case len(included) == 0:
+			slog.Warn("no diffs to combine")
+		default:
+			slog.Info("combined the diffs", "file", path.Join(dest, goru.CombinedDiff),
+				"arches", strings.Join(included, ","))
+		}
+	}
+
+	if *jsonOut {
+		err = res.WriteJSON(os.Stdout)
+	} else {
+		err = res.WriteTable(os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if res.Failed() {
+		os.Exit(1)
+	}
+}
+
+// clean removes the release's directory under dest, or only the
+// directories of arches when any are given. Without yes it only says
+// what it would remove.
+func clean(dest string, arches []string, yes bool) error {
+	dirs := []string{dest}
+	if len(arches) > 0 {
+		dirs = nil
+		for _, arch := range arches {
+			if arch == "" || path.Base(arch) != arch || arch == "." || arch == ".." {
+				return fmt.Errorf("invalid -arch %q", arch)
+			}
+			dirs = append(dirs, path.Join(dest, arch))
+		}
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); err != nil {
+			if os.IsNotExist(err) {
+				fmt.Printf("\t%s doesn't exist\n", dir)
+				continue
+			}
+			return err
+		}
+		if !yes {
+			fmt.Printf("\twould remove %s, run again with -yes to remove it\n", dir)
+			continue
+		}
+		fmt.Printf("\tremoving %s\n", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectSets returns the sets -os and -config describe, narrowed down
+// to -arch when it's given.
+func selectSets(cfg *goru.Config, osName, configFile string, arches []string, smushVer string) (goru.Sets, error) {
+	var sets goru.Sets
+	var err error
+	switch {
+	case osName == "netbsd" && configFile != "":
+		return nil, errors.New("-config only describes OpenBSD arches")
+	case osName == "netbsd" && cfg.Transport != "http":
+		return nil, errors.New("NetBSD guests only support -transport http")
+	case osName == "netbsd":
+		sets = goru.NetBSDSets(cfg)
+	case osName != "openbsd":
+		return nil, fmt.Errorf("unknown -os %q, expected openbsd or netbsd", osName)
+	case configFile != "":
+		sets, err = goru.LoadSets(cfg, configFile, smushVer)
+	default:
+		sets, err = goru.DefaultSets(cfg, smushVer)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(arches) > 0 {
+		sets, err = sets.Only(arches)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sets.Sort()
+	return sets, nil
+}
+
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".goru")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// runHook runs cmd with the shell, passing details about the build in
+// its environment.
+func runHook(cmd, arch, release, diffPath, status string) error {
+	hook := exec.Command("/bin/sh", "-c", cmd)
+	hook.Stdout = os.Stdout
+	hook.Stderr = os.Stderr
+	hook.Env = append(os.Environ(),
+		"GORU_ARCH="+arch,
+		"GORU_RELEASE="+release,
+		"GORU_DIFF_PATH="+diffPath,
+		"GORU_STATUS="+status,
+	)
+	return hook.Run()
+}
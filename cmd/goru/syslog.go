@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// priorityWriter logs a message at one of syslog's priorities, which
+// *syslog.Writer does.
+type priorityWriter interface {
+	Err(m string) error
+	Warning(m string) error
+	Info(m string) error
+	Debug(m string) error
+}
+
+// syslogHandler sends log records to syslog at the priority matching
+// their level, formatted like the text handler without the time,
+// which syslog adds itself.
+type syslogHandler struct {
+	w   priorityWriter
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+	h   slog.Handler // formats a record into buf
+}
+
+func newSyslogHandler(w priorityWriter, level slog.Leveler) *syslogHandler {
+	buf := new(bytes.Buffer)
+	return &syslogHandler{
+		w:   w,
+		mu:  new(sync.Mutex),
+		buf: buf,
+		h: slog.NewTextHandler(buf, &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}),
+	}
+}
+
+func (s *syslogHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return s.h.Enabled(ctx, l)
+}
+
+func (s *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf.Reset()
+	if err := s.h.Handle(ctx, r); err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(s.buf.String(), "\n")
+	switch {
+	case r.Level >= slog.LevelError:
+		return s.w.Err(msg)
+	case r.Level >= slog.LevelWarn:
+		return s.w.Warning(msg)
+	case r.Level >= slog.LevelInfo:
+		return s.w.Info(msg)
+	default:
+		return s.w.Debug(msg)
+	}
+}
+
+func (s *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *s
+	c.h = s.h.WithAttrs(attrs)
+	return &c
+}
+
+func (s *syslogHandler) WithGroup(name string) slog.Handler {
+	c := *s
+	c.h = s.h.WithGroup(name)
+	return &c
+}
+
+// teeHandler passes records on to each of its handlers.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := make(teeHandler, len(t))
+	for i, h := range t {
+		c[i] = h.WithAttrs(attrs)
+	}
+	return c
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	c := make(teeHandler, len(t))
+	for i, h := range t {
+		c[i] = h.WithGroup(name)
+	}
+	return c
+}
+
+// syslogErrors writes to syslog at LOG_ERR, which is where log.Fatal's
+// messages belong.
+type syslogErrors struct {
+	w priorityWriter
+}
+
+func (s syslogErrors) Write(p []byte) (int, error) {
+	return len(p), s.w.Err(strings.TrimSuffix(string(p), "\n"))
+}
+
+// syslogLines sends what's written to it to syslog a line at a time,
+// rather than in the pieces the guest's console arrives in.
+func syslogLines(w priorityWriter) io.Writer {
+	pr, pw := io.Pipe()
+	go func() {
+		sc := bufio.NewScanner(pr)
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			if line := strings.TrimRight(sc.Text(), "\r"); line != "" {
+				w.Info(line)
+			}
+		}
+		// A line too long to scan mustn't block the console.
+		io.Copy(io.Discard, pr)
+	}()
+	return pw
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeSyslog records each message with its priority.
+type fakeSyslog chan string
+
+func (f fakeSyslog) log(pri, m string) error {
+	f <- pri + ": " + m
+	return nil
+}
+
+func (f fakeSyslog) Err(m string) error     { return f.log("err", m) }
+func (f fakeSyslog) Warning(m string) error { return f.log("warning", m) }
+func (f fakeSyslog) Info(m string) error    { return f.log("info", m) }
+func (f fakeSyslog) Debug(m string) error   { return f.log("debug", m) }
+
+func (f fakeSyslog) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case m := <-f:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing sent to syslog")
+		return ""
+	}
+}
+
+func TestSyslogHandlerPriorities(t *testing.T) {
+	f := make(fakeSyslog, 10)
+	l := slog.New(newSyslogHandler(f, slog.LevelDebug)).With("arch", "amd64")
+	l.Debug("booting")
+	l.Info("fetched", "file", "bsd.rd")
+	l.Warn("retrying")
+	l.Error("build failed", "err", fmt.Errorf("no diff"))
+
+	for _, want := range []string{
+		"debug: level=DEBUG msg=booting arch=amd64",
+		"info: level=INFO msg=fetched arch=amd64 file=bsd.rd",
+		"warning: level=WARN msg=retrying arch=amd64",
+		`err: level=ERROR msg="build failed" arch=amd64 err="no diff"`,
+	} {
+		if got := f.next(t); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestSyslogHandlerLevel(t *testing.T) {
+	f := make(fakeSyslog, 10)
+	l := slog.New(teeHandler{newSyslogHandler(f, slog.LevelWarn)})
+	l.Info("quiet")
+	l.Warn("loud")
+	if got, want := f.next(t), "warning: level=WARN msg=loud"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	select {
+	case m := <-f:
+		t.Errorf("unexpected %q", m)
+	default:
+	}
+}
+
+func TestSyslogLines(t *testing.T) {
+	f := make(fakeSyslog, 10)
+	w := syslogLines(f)
+	// The console arrives in whatever pieces qemu wrote it in.
+	for _, p := range []string{"OpenBSD/amd64 BO", "OT 3.65\r\n\r\nboot", "> \r\n"} {
+		if _, err := w.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for range 2 {
+		got = append(got, f.next(t))
+	}
+	want := []string{"info: OpenBSD/amd64 BOOT 3.65", "info: boot> "}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,297 @@
+package goru
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	sectorSize = 512
+
+	mbrOpenBSD    = 0xa6
+	mbrProtective = 0xee
+
+	diskMagic = 0x82564557
+)
+
+// gptOpenBSD is the OpenBSD data partition type GUID in its on-disk
+// byte order.
+var gptOpenBSD = []byte{
+	0xa0, 0xc7, 0x4c, 0x82, 0xa8, 0x36, 0xe3, 0x11,
+	0x89, 0x0a, 0x95, 0x25, 0x19, 0xad, 0x3f, 0x61,
+}
+
+func readSector(f io.ReaderAt, lba uint64) ([]byte, error) {
+	b := make([]byte, sectorSize)
+	_, err := f.ReadAt(b, int64(lba*sectorSize))
+	return b, err
+}
+
+// openbsdPartition returns the first sector of the OpenBSD partition
+// from either the MBR or a GPT.
+func openbsdPartition(f io.ReaderAt) (uint64, error) {
+	mbr, err := readSector(f, 0)
+	if err != nil {
+		return 0, err
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return 0, errors.New("no boot signature")
+	}
+
+	for i := 0; i < 4; i++ {
+		e := mbr[446+i*16 : 446+(i+1)*16]
+		switch e[4] {
+		case mbrOpenBSD:
+			return uint64(binary.LittleEndian.Uint32(e[8:])), nil
+		case mbrProtective:
+			return gptPartition(f)
+		}
+	}
+
+	return 0, errors.New("no OpenBSD partition")
+}
+
+func gptPartition(f io.ReaderAt) (uint64, error) {
+	hdr, err := readSector(f, 1)
+	if err != nil {
+		return 0, err
+	}
+	if string(hdr[:8]) != "EFI PART" {
+		return 0, errors.New("bad GPT header")
+	}
+
+	start := binary.LittleEndian.Uint64(hdr[72:])
+	count := binary.LittleEndian.Uint32(hdr[80:])
+	size := binary.LittleEndian.Uint32(hdr[84:])
+	if size < 128 || count > 1024 {
+		return 0, errors.New("bad GPT header")
+	}
+
+	ents := make([]byte, int(count)*int(size))
+	if _, err := f.ReadAt(ents, int64(start*sectorSize)); err != nil {
+		return 0, err
+	}
+	for i := 0; i < int(count); i++ {
+		e := ents[i*int(size):]
+		if bytes.Equal(e[:16], gptOpenBSD) {
+			return binary.LittleEndian.Uint64(e[32:]), nil
+		}
+	}
+
+	return 0, errors.New("no OpenBSD partition")
+}
+
+// checkInstalled makes sure the raw disk holds a finished install
+// rather than a blank image or just the miniroot written by dd. The
+// miniroot carries its own small disklabel, an installed disk has one
+// spanning the whole image.
+func checkInstalled(disk string) error {
+	f, err := os.Open(disk)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return checkLabel(f, fi.Size(), disk)
+}
+
+// checkInstalledImage is checkInstalled for a disk in any format, with
+// images other than raw read through qemu-img.
+func (c *Config) checkInstalledImage(ctx context.Context, disk, format string) error {
+	if format == "raw" {
+		return checkInstalled(disk)
+	}
+	size, err := c.virtualSize(ctx, disk, format)
+	if err != nil {
+		return err
+	}
+	r := &imageReader{ctx: ctx, runner: c.Runner, image: disk, format: format}
+	return checkLabel(r, size, disk)
+}
+
+// checkLabel checks the disklabel of disk, read from f, spans most of
+// its size bytes.
+func checkLabel(f io.ReaderAt, size int64, disk string) error {
+	start, err := openbsdPartition(f)
+	if err != nil {
+		return fmt.Errorf("%s isn't an OpenBSD install: %w", disk, err)
+	}
+
+	label, err := readSector(f, start+1)
+	if err != nil {
+		return fmt.Errorf("%s isn't an OpenBSD install: %w", disk, err)
+	}
+	if binary.LittleEndian.Uint32(label) != diskMagic {
+		return fmt.Errorf("%s isn't an OpenBSD install: no disklabel", disk)
+	}
+
+	secSize := int64(binary.LittleEndian.Uint32(label[40:]))
+	labelSize := int64(binary.LittleEndian.Uint32(label[60:])) * secSize
+	if labelSize < size/2 {
+		return fmt.Errorf("%s only has a %d byte disklabel, the install didn't finish",
+			disk, labelSize)
+	}
+
+	return nil
+}
+
+// virtualSize asks qemu-img for the size of the disk the guest sees in
+// image.
+func (c *Config) virtualSize(ctx context.Context, image, format string) (int64, error) {
+	cmd := []string{"qemu-img", "info", "--output=json", "-f", format, path.Base(image)}
+	out, err := c.Runner.Run(ctx, path.Dir(image), cmd[0], cmd[1:]...)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't read %s: %s: %s\n%s", image, shellQuote(cmd), err, out)
+	}
+	// Warnings on stderr come before the JSON.
+	if i := bytes.IndexByte(out, '{'); i > 0 {
+		out = out[i:]
+	}
+	var info struct {
+		VirtualSize int64 `json:"virtual-size"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return 0, fmt.Errorf("couldn't read %s: %s: %w", image, shellQuote(cmd), err)
+	}
+	return info.VirtualSize, nil
+}
+
+// imageReader reads the guest's view of a disk image through qemu-img
+// dd, copying the sectors asked for next to the image.
+type imageReader struct {
+	ctx    context.Context
+	runner Runner
+	image  string
+	format string
+}
+
+func (r *imageReader) ReadAt(b []byte, off int64) (int, error) {
+	skip := off / sectorSize
+	count := (off%sectorSize + int64(len(b)) + sectorSize - 1) / sectorSize
+	dir, tmp := path.Dir(r.image), "."+path.Base(r.image)+".sectors"
+	os.Remove(path.Join(dir, tmp))
+	defer os.Remove(path.Join(dir, tmp))
+
+	cmd := []string{"qemu-img", "dd", "-f", r.format, "-O", "raw",
+		"bs=" + strconv.Itoa(sectorSize),
+		"skip=" + strconv.FormatInt(skip, 10),
+		"count=" + strconv.FormatInt(count, 10),
+		"if=" + path.Base(r.image), "of=" + tmp}
+	if out, err := r.runner.Run(r.ctx, dir, cmd[0], cmd[1:]...); err != nil {
+		return 0, fmt.Errorf("%s: %w\n%s", shellQuote(cmd), err, out)
+	}
+
+	f, err := os.Open(path.Join(dir, tmp))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(b, off%sectorSize)
+}
+
+// LayoutMinimum adds up the smallest size each partition of an
+// autopartitioning template may have, in bytes. Sizes are either
+// sectors or carry a k, m, g or t suffix, and * means any size.
+func LayoutMinimum(layout string) (int64, error) {
+	var total int64
+	for _, line := range strings.Split(layout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return 0, fmt.Errorf("no size for %q in disklabel template", fields[0])
+		}
+		min, _, _ := strings.Cut(fields[1], "-")
+		size, err := parseSize(min)
+		if err != nil {
+			return 0, fmt.Errorf("bad size for %q in disklabel template: %w", fields[0], err)
+		}
+		total += size
+	}
+	return total, nil
+}
+
+func parseSize(s string) (int64, error) {
+	if s == "*" {
+		return 0, nil
+	}
+	mult := int64(sectorSize)
+	if s != "" {
+		if u := strings.IndexByte("kmgt", s[len(s)-1]|0x20); u >= 0 {
+			mult = 1 << (10 * (u + 1))
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mult, nil
+}
+
+// imageSize is the space creating a disk image takes up front. Raw
+// images are preallocated, qcow2 ones grow as the guest writes.
+func (c *Config) imageSize() int64 {
+	if c.DiskFormat != "raw" {
+		return 0
+	}
+	return int64(c.DiskSize) << 20
+}
+
+// imageNeeds is the space creating the disk image in outDir takes
+// beyond what it has now, as one left by an earlier run is replaced.
+func (c *Config) imageNeeds(outDir string) int64 {
+	need := c.imageSize()
+	if fi, err := os.Stat(path.Join(outDir, c.diskFile())); err == nil {
+		need -= fi.Size()
+	}
+	return need
+}
+
+// createsDisk reports whether the stages being run create a disk image
+// in outDir rather than boot one that's there.
+func (c *Config) createsDisk(outDir string) bool {
+	if !c.Stages["build"] && !c.Stages["install"] {
+		return false
+	}
+	switch {
+	case c.BaseImage:
+		_, err := os.Stat(path.Join(outDir, c.baseFile()))
+		return err != nil
+	case c.KeepDisk || c.Snapshot:
+		_, err := os.Stat(path.Join(outDir, c.diskFile()))
+		return err != nil
+	}
+	return true
+}
+
+// checkSpace makes sure the filesystem holding dir has need bytes
+// free for what, so a run doesn't fail halfway through writing it.
+func checkSpace(dir string, need int64, what string) error {
+	free, err := freeSpace(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if free < need {
+		return fmt.Errorf("not enough space for %s: need %s, %s free in %s",
+			what, mib(need), mib(free), dir)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package goru
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int64
+	}{
+		{"*", 0},
+		{"2048", 2048 * sectorSize},
+		{"64k", 64 << 10},
+		{"300M", 300 << 20},
+		{"5g", 5 << 30},
+		{"1T", 1 << 40},
+	} {
+		got, err := parseSize(tc.in)
+		if err != nil {
+			t.Errorf("parseSize(%q): %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseSize(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+	for _, in := range []string{"", "m", "5x", "-"} {
+		if _, err := parseSize(in); err == nil {
+			t.Errorf("parseSize(%q) succeeded", in)
+		}
+	}
+}
+
+func TestLayoutMinimum(t *testing.T) {
+	got, err := LayoutMinimum(DefaultDiskLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(6 << 30); got != want {
+		t.Errorf("default layout needs %d bytes, want %d", got, want)
+	}
+
+	got, err = LayoutMinimum("# comment\n\n/\t1G-*\t95%\nswap\t80M-256M\t5%\n/tmp\t*\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(1<<30 + 80<<20); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	for _, layout := range []string{"/", "/\tlots"} {
+		if _, err := LayoutMinimum(layout); err == nil {
+			t.Errorf("LayoutMinimum(%q) succeeded", layout)
+		}
+	}
+}
+
+// writeImage writes a raw disk of size bytes with an MBR OpenBSD
+// partition at sector 64 whose disklabel covers labelSize bytes.
+func writeImage(t *testing.T, file string, size, labelSize int64) {
+	t.Helper()
+	b := make([]byte, 66*sectorSize)
+	e := b[446:]
+	e[4] = mbrOpenBSD
+	binary.LittleEndian.PutUint32(e[8:], 64)
+	b[510], b[511] = 0x55, 0xaa
+
+	label := b[65*sectorSize:]
+	binary.LittleEndian.PutUint32(label, diskMagic)
+	binary.LittleEndian.PutUint32(label[40:], sectorSize)
+	binary.LittleEndian.PutUint32(label[60:], uint32(labelSize/sectorSize))
+
+	if err := os.WriteFile(file, b, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(file, size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// qemuImg answers qemu-img info and dd as if the images it's asked
+// about were qcow2, when they're really raw.
+type qemuImg struct {
+	recordingRunner
+}
+
+func (q *qemuImg) Run(ctx context.Context, dir, name string, args ...string) ([]byte, error) {
+	q.recordingRunner.Run(ctx, dir, name, args...)
+	switch {
+	case name == "qemu-img" && args[0] == "info":
+		fi, err := os.Stat(path.Join(dir, args[len(args)-1]))
+		if err != nil {
+			return nil, err
+		}
+		return []byte(fmt.Sprintf("WARNING: ignored\n{\"virtual-size\": %d}\n", fi.Size())), nil
+	case name == "qemu-img" && args[0] == "dd":
+		opts := map[string]string{}
+		for _, a := range args[1:] {
+			if k, v, ok := strings.Cut(a, "="); ok {
+				opts[k] = v
+			}
+		}
+		skip, _ := strconv.ParseInt(opts["skip"], 10, 64)
+		count, _ := strconv.ParseInt(opts["count"], 10, 64)
+		f, err := os.Open(path.Join(dir, opts["if"]))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		b := make([]byte, count*sectorSize)
+		n, _ := f.ReadAt(b, skip*sectorSize)
+		return nil, os.WriteFile(path.Join(dir, opts["of"]), b[:n], 0640)
+	}
+	return nil, fmt.Errorf("unexpected %s %q", name, args)
+}
+
+func TestCheckInstalledImage(t *testing.T) {
+	const size = 64 << 20
+	for _, tc := range []struct {
+		name      string
+		labelSize int64
+		ok        bool
+	}{
+		{"installed", size, true},
+		{"miniroot", 4 << 20, false},
+	} {
+		for _, format := range []string{"raw", "qcow2"} {
+			t.Run(tc.name+"/"+format, func(t *testing.T) {
+				q := &qemuImg{}
+				cfg := &Config{Runner: q}
+				disk := path.Join(t.TempDir(), "disk."+format)
+				writeImage(t, disk, size, tc.labelSize)
+
+				err := cfg.checkInstalledImage(context.Background(), disk, format)
+				if tc.ok && err != nil {
+					t.Errorf("rejected an installed disk: %v", err)
+				}
+				if !tc.ok && err == nil {
+					t.Error("took the miniroot for an install")
+				}
+				if format == "raw" && len(q.calls) > 0 {
+					t.Errorf("ran %q for a raw disk", q.calls)
+				}
+				if format == "qcow2" && len(q.calls) == 0 {
+					t.Error("read the qcow2 disk without qemu-img")
+				}
+			})
+		}
+	}
+}
+
+func TestCheckInstalledBlank(t *testing.T) {
+	cfg := &Config{Runner: &qemuImg{}}
+	disk := path.Join(t.TempDir(), "disk.qcow2")
+	if err := os.WriteFile(disk, nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(disk, 64<<20); err != nil {
+		t.Fatal(err)
+	}
+	err := cfg.checkInstalledImage(context.Background(), disk, "qcow2")
+	if err == nil || !strings.Contains(err.Error(), "isn't an OpenBSD install") {
+		t.Errorf("got %v for a blank disk", err)
+	}
+}
@@ -0,0 +1,75 @@
+package goru
+
+import (
+	"fmt"
+	"path"
+)
+
+// dryFetch writes what Fetch would download.
+func (o *OpenBSD) dryFetch(ver string) {
+	w := o.cfg.out()
+	for _, file := range o.sets {
+		fmt.Fprintf(w, "\twould fetch %s\n", fmt.Sprintf(o.cfg.Mirrors[0], ver, o.arch, file))
+	}
+}
+
+// dryVerify writes what Verify would check.
+func (o *OpenBSD) dryVerify() {
+	w := o.cfg.out()
+	for _, file := range o.sets {
+		if isSigFile(file) || file == "index.txt" {
+			continue
+		}
+		if o.cfg.SHA256Only {
+			fmt.Fprintf(w, "\twould verify %s against SHA256\n", file)
+		} else {
+			fmt.Fprintf(w, "\twould verify %s against SHA256 and SHA256.sig\n", file)
+		}
+	}
+}
+
+// dryBuild writes the files served to the installer and the commands
+// Build would run.
+func (o *OpenBSD) dryBuild(dest, smushVer, instConf string) {
+	w := o.cfg.out()
+	fmt.Fprintf(w, "\tinstall.conf:\n%s", instConf)
+	fmt.Fprintf(w, "\tdisklabel:\n%s", o.cfg.DiskLayout)
+	outDir := path.Join(dest, o.arch)
+	disk, format := path.Join(outDir, o.cfg.diskFile()), o.cfg.DiskFormat
+	if o.cfg.BaseImage {
+		fmt.Fprintf(w, "\twould boot an overlay of %s, installing it first if it's missing\n", o.cfg.baseFile())
+		disk, format = path.Join(outDir, overlayFile), "qcow2"
+	} else if !o.cfg.KeepDisk && !o.cfg.Snapshot {
+		for _, c := range o.diskCmds(fmt.Sprintf("miniroot%s.img", smushVer)) {
+			fmt.Fprintf(w, "\twould run in %s: %s\n", outDir, shellQuote(c))
+		}
+	}
+	fmt.Fprintf(w, "\twould run %s\n", shellQuote(o.qemuArgs(disk, format)))
+}
+
+// dryInstall writes what Install would do.
+func (o *OpenBSD) dryInstall(dest, smushVer, instConf string) {
+	w := o.cfg.out()
+	fmt.Fprintf(w, "\tinstall.conf:\n%s", instConf)
+	fmt.Fprintf(w, "\tdisklabel:\n%s", o.cfg.DiskLayout)
+	outDir := path.Join(dest, o.arch)
+	for _, c := range o.diskCmds(fmt.Sprintf("miniroot%s.img", smushVer)) {
+		fmt.Fprintf(w, "\twould run in %s: %s\n", outDir, shellQuote(c))
+	}
+	fmt.Fprintf(w, "\twould run %s\n", shellQuote(o.qemuArgs(path.Join(outDir, o.cfg.diskFile()), o.cfg.DiskFormat)))
+	if o.cfg.BaseImage {
+		fmt.Fprintf(w, "\twould rename %s to %s\n", o.cfg.diskFile(), o.cfg.baseFile())
+	}
+}
+
+// dryRun writes what Run would do.
+func (o *OpenBSD) dryRun(dest string) {
+	w := o.cfg.out()
+	outDir := path.Join(dest, o.arch)
+	disk, format := path.Join(outDir, o.cfg.diskFile()), o.cfg.DiskFormat
+	if o.cfg.BaseImage {
+		fmt.Fprintf(w, "\twould boot an overlay of %s\n", o.cfg.baseFile())
+		disk, format = path.Join(outDir, overlayFile), "qcow2"
+	}
+	fmt.Fprintf(w, "\twould run %s\n", shellQuote(o.qemuArgs(disk, format)))
+}
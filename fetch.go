@@ -0,0 +1,711 @@
+package goru
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// UserAgent is sent with every request to a mirror.
+const UserAgent = "goru (+https://github.com/qbit/goru)"
+
+// dialTimeout and headerTimeout bound connecting to a mirror and
+// waiting for it to start answering, however long the download may
+// take after that.
+const (
+	dialTimeout   = 30 * time.Second
+	headerTimeout = time.Minute
+)
+
+// NewClient returns the client for talking to mirrors, opening at
+// most maxConns connections to each and giving up on a request when
+// the mirror sends nothing for idle, 0 meaning never. There's no limit
+// on the whole request, which a slow link or Limiter can stretch as
+// long as the set needs.
+func NewClient(idle time.Duration, maxConns int) *http.Client {
+	var rt http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   dialTimeout,
+		ResponseHeaderTimeout: headerTimeout,
+		MaxConnsPerHost:       maxConns,
+		MaxIdleConnsPerHost:   maxConns,
+	}
+	if idle > 0 {
+		rt = idleTimeout{rt, idle}
+	}
+	return &http.Client{Transport: userAgent{rt}}
+}
+
+// errIdle is a response body the mirror stopped sending.
+var errIdle = errors.New("mirror stopped sending")
+
+// idleTimeout cancels requests whose response body has a read wait
+// longer than d.
+type idleTimeout struct {
+	rt http.RoundTripper
+	d  time.Duration
+}
+
+func (t idleTimeout) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	resp, err := t.rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	timer := time.AfterFunc(t.d, func() { cancel(errIdle) })
+	timer.Stop()
+	resp.Body = &idleBody{resp.Body, ctx, cancel, timer, t.d}
+	return resp, nil
+}
+
+// idleBody only runs its timer while waiting on the mirror, so time a
+// reader spends elsewhere, like in the Limiter, doesn't count.
+type idleBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	timer  *time.Timer
+	d      time.Duration
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.d)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if err != nil && errors.Is(context.Cause(b.ctx), errIdle) {
+		err = fmt.Errorf("%w for %s", errIdle, b.d)
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
+
+// userAgent sets UserAgent on requests that don't have one.
+type userAgent struct {
+	rt http.RoundTripper
+}
+
+func (u userAgent) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", UserAgent)
+	}
+	return u.rt.RoundTrip(req)
+}
+
+// NewLimiter returns a limiter for Config.Limiter keeping downloads
+// to bytesPerSec between them.
+func NewLimiter(bytesPerSec int) *rate.Limiter {
+	// Reads are cut to the burst, so it's kept big enough for them
+	// not to be tiny.
+	return rate.NewLimiter(rate.Limit(bytesPerSec), max(bytesPerSec, 32<<10))
+}
+
+// limited returns r, reading no faster than Limiter allows when it's
+// set.
+func (c *Config) limited(ctx context.Context, r io.Reader) io.Reader {
+	if c.Limiter == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, l: c.Limiter}
+}
+
+// limitedReader waits on l after every read, so readers sharing it
+// stay under its rate together.
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *rate.Limiter
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	if len(b) > r.l.Burst() {
+		b = b[:r.l.Burst()]
+	}
+	n, err := r.r.Read(b)
+	if n > 0 {
+		if werr := r.l.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// statusError is a non-200, non-404 response from a mirror.
+type statusError struct {
+	url    string
+	status string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.url, e.status)
+}
+
+// retryable reports whether a failed download is worth another
+// attempt: network errors and server errors are, missing files and
+// other client errors aren't.
+func retryable(err error) bool {
+	if errors.Is(err, errNotFound) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500
+	}
+	return true
+}
+
+// get requests file from each mirror in turn, moving on after
+// connection errors and non-200 responses. It returns the response
+// along with the host that served it, after any redirects. Requests with a Range header
+// also accept 206, and conditional ones 304.
+func (o *OpenBSD) get(ctx context.Context, ver, file string, h http.Header) (*http.Response, string, error) {
+	err := errNotFound
+	for _, m := range o.cfg.Mirrors {
+		u := fmt.Sprintf(m, ver, o.arch, file)
+		req, rErr := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if rErr != nil {
+			return nil, "", rErr
+		}
+		for k, v := range h {
+			req.Header[k] = v
+		}
+		resp, gErr := o.cfg.Client.Do(req)
+		if gErr != nil {
+			if ctx.Err() != nil {
+				return nil, "", ctx.Err()
+			}
+			slog.Warn("mirror failed", "arch", o.arch, "file", file, "err", gErr)
+			err = gErr
+			continue
+		}
+		switch {
+		case resp.StatusCode == http.StatusOK:
+		case resp.StatusCode == http.StatusPartialContent && h.Get("Range") != "":
+		case resp.StatusCode == http.StatusNotModified &&
+			(h.Get("If-None-Match") != "" || h.Get("If-Modified-Since") != ""):
+		default:
+			resp.Body.Close()
+			slog.Warn("mirror refused", "arch", o.arch, "file", file, "url", u, "status", resp.Status)
+			if resp.StatusCode != http.StatusNotFound {
+				err = &statusError{u, resp.Status, resp.StatusCode}
+			}
+			continue
+		}
+		return resp, resp.Request.URL.Host, nil
+	}
+	return nil, "", err
+}
+
+// versionedSet matches set files carrying a release suffix, like
+// base75.tgz or miniroot75.img.
+var versionedSet = regexp.MustCompile(`^([a-z]+)(\d+)\.(tgz|img)$`)
+
+// indexSet matches the files in index.txt that Fetch wants: the
+// kernels, the miniroot and the sets the install picks from. Other
+// install media and sets are left on the mirror.
+var indexSet = regexp.MustCompile(`^(bsd(\.[a-z]+)?|(base|comp|man|xbase)\d+\.tgz|miniroot\d+\.img)$`)
+
+// parseIndex reads the sets listed in an index.txt, which is the ls -l
+// output of the release directory.
+func parseIndex(file string) (setList, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sl setList
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		name := fields[len(fields)-1]
+		if indexSet.MatchString(name) {
+			sl = append(sl, name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(sl) == 0 {
+		return nil, fmt.Errorf("no sets found in %s", file)
+	}
+
+	return sl, nil
+}
+
+// indexSizes returns the sizes of the files index.txt lists, which is
+// the output of ls -l.
+func indexSizes(file string) (map[string]int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sizes := map[string]int64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 9 {
+			continue
+		}
+		if n, err := strconv.ParseInt(fields[4], 10, 64); err == nil {
+			sizes[fields[len(fields)-1]] = n
+		}
+	}
+	return sizes, scanner.Err()
+}
+
+// checkFetchSpace makes sure there's room for the sets that aren't
+// fully fetched yet, and for the disk image when the run goes on to
+// create one.
+func (o *OpenBSD) checkFetchSpace(outDir string) error {
+	sizes, err := indexSizes(path.Join(outDir, "index.txt"))
+	if err != nil {
+		return err
+	}
+	var need int64
+	for _, file := range o.sets {
+		size, ok := sizes[file]
+		if !ok {
+			continue
+		}
+		if fi, err := os.Stat(path.Join(outDir, file)); err == nil {
+			size -= fi.Size()
+		}
+		need += max(size, 0)
+	}
+	what := fmt.Sprintf("the %s sets", o.arch)
+	if o.cfg.createsDisk(outDir) {
+		need += max(o.cfg.imageNeeds(outDir), 0)
+		what = fmt.Sprintf("the %s sets and %s", o.arch, o.cfg.diskFile())
+	}
+	return checkSpace(outDir, need, what)
+}
+
+// useIndex replaces the default set list with the sets listed in
+// outDir's index.txt, unless -config gave the list.
+func (o *OpenBSD) useIndex(outDir string) error {
+	if o.fixedSets {
+		return nil
+	}
+	sets, err := parseIndex(path.Join(outDir, "index.txt"))
+	if err != nil {
+		return err
+	}
+	o.sets = append(setList{"SHA256.sig", "SHA256", "index.txt"}, sets...)
+	return nil
+}
+
+// SnapshotVersion works out which release the snapshots on the mirror
+// lead up to from the set names in arch's index.txt, base76.tgz being
+// a 7.6 snapshot. The sets, miniroot and signing key all carry it.
+func SnapshotVersion(ctx context.Context, cfg *Config, arch string) (string, error) {
+	o := &OpenBSD{arch: arch, cfg: cfg}
+	resp, _, err := o.get(ctx, "snapshots", "index.txt", nil)
+	if err != nil {
+		return "", fmt.Errorf("can't get the snapshot index for %q: %w", o.arch, err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if m := versionedSet.FindStringSubmatch(fields[len(fields)-1]); m != nil {
+			return m[2], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no versioned sets in the snapshot index for %q", o.arch)
+}
+
+// checkRelease makes sure outDir doesn't hold sets from a release other
+// than smushVer, as Fetch would otherwise mix them with the new ones.
+func checkRelease(outDir, smushVer string) error {
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		return err
+	}
+
+	var stale []string
+	for _, e := range entries {
+		m := versionedSet.FindStringSubmatch(e.Name())
+		if m != nil && m[2] != smushVer {
+			stale = append(stale, e.Name())
+		}
+	}
+	if len(stale) > 0 {
+		return fmt.Errorf("%s has sets from another release (%s), remove them or use a different destination",
+			outDir, strings.Join(stale, ", "))
+	}
+
+	return nil
+}
+
+// Fetch downloads the sets for the arch into dest, running up to
+// -jobs downloads at once. The first failure stops the rest.
+func (o *OpenBSD) Fetch(parent context.Context, dest, ver, smushVer string) error {
+	if o.cfg.DryRun {
+		o.dryFetch(ver)
+		return nil
+	}
+
+	outDir := path.Join(dest, o.arch)
+	err := os.MkdirAll(outDir, 0750)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	err = checkRelease(outDir, smushVer)
+	if err != nil {
+		return err
+	}
+
+	// A missing or unreadable manifest only means the sets on disk
+	// are taken as they are.
+	o.known, _ = ReadManifest(outDir)
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	// index.txt says which sets this release has for the arch, so
+	// it comes first.
+	err = o.fetchFile(ctx, outDir, ver, "index.txt")
+	if err != nil {
+		return err
+	}
+	if err := o.useIndex(outDir); err != nil {
+		slog.Warn("using the default set list", "arch", o.arch, "err", err)
+	}
+	if err := o.checkFetchSpace(outDir); err != nil {
+		return err
+	}
+
+	files := make(chan string)
+	errs := make(chan error, len(o.sets))
+	var wg sync.WaitGroup
+	for i := 0; i < o.cfg.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range files {
+				if err := o.fetchFile(ctx, outDir, ver, file); err != nil {
+					errs <- err
+					cancel()
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, file := range o.sets {
+		if file == "index.txt" {
+			continue
+		}
+		select {
+		case files <- file:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(files)
+	wg.Wait()
+	close(errs)
+
+	var failed []error
+	for err := range errs {
+		// Downloads interrupted by the first failure aren't
+		// interesting.
+		if !errors.Is(err, context.Canceled) {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Join(failed...)
+	}
+	if err := parent.Err(); err != nil {
+		return err
+	}
+
+	return o.writeManifest(outDir, ver)
+}
+
+func (o *OpenBSD) fetchFile(ctx context.Context, outDir, ver, file string) error {
+	fp := path.Join(outDir, file)
+	slog.Info("fetching", "arch", o.arch, "file", file)
+	// Always fetch SHA256.sig and missing files, or everything with
+	// -force. -conditional asks the mirror whether the others changed.
+	fi, err := os.Stat(fp)
+	if !o.cfg.Force && !o.cfg.Conditional && file != "SHA256.sig" && !os.IsNotExist(err) {
+		// A file that isn't the size the manifest recorded was
+		// cut short or changed since, and is fetched again.
+		e := o.known.entry(file)
+		if e == nil || err != nil || e.Size == fi.Size() {
+			return nil
+		}
+		slog.Info("size differs from the manifest, fetching again", "arch", o.arch, "file", file,
+			"size", fi.Size(), "manifest_size", e.Size)
+	}
+
+	delay := o.cfg.RetryDelay
+	for try := 1; ; try++ {
+		err := o.download(ctx, fp, ver, file)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, errNotFound) {
+			if !o.cfg.Optional[file] {
+				return fmt.Errorf("fetch %s/%s: %w", o.arch, file, ErrSetMissing)
+			}
+			slog.Info("optional file missing, skipping", "arch", o.arch, "file", file)
+			return nil
+		}
+		if !retryable(err) || try >= o.cfg.Retries {
+			return fmt.Errorf("fetch %s/%s: %w", o.arch, file, err)
+		}
+		slog.Warn("download failed, retrying", "arch", o.arch, "file", file, "err", err,
+			"delay", delay, "attempt", try+1, "max_attempts", o.cfg.Retries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// download makes a single attempt at fetching file into fp. Sets are
+// written to fp.part first, and a part left by an earlier attempt is
+// resumed rather than fetched again.
+func (o *OpenBSD) download(ctx context.Context, fp, ver, file string) error {
+	part := fp + ".part"
+	h := http.Header{}
+	var offset int64
+	// The checksum files are tiny and always fetched again.
+	if !o.cfg.Force && file != "SHA256" && file != "SHA256.sig" {
+		// The part is only resumed along with the validator it was
+		// fetched under, so a set changed on the mirror since comes
+		// back whole instead of spliced onto the old one.
+		if fi, err := os.Stat(part); err == nil && readValidators(part, h) {
+			offset = fi.Size()
+			h.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+	}
+	if o.cfg.Conditional && !o.cfg.Force && offset == 0 {
+		if _, err := os.Stat(fp); err == nil {
+			readValidators(fp, h)
+		}
+	}
+
+	resp, host, err := o.get(ctx, ver, file, h)
+	var se *statusError
+	if offset > 0 && errors.As(err, &se) && se.code == http.StatusRequestedRangeNotSatisfiable {
+		// The part doesn't fit what the mirror has, start over.
+		h.Del("Range")
+		h.Del("If-Range")
+		resp, host, err = o.get(ctx, ver, file, h)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		slog.Info("unchanged on the mirror", "arch", o.arch, "file", file, "host", host)
+		return nil
+	case http.StatusPartialContent:
+		flags = os.O_WRONLY | os.O_APPEND
+		slog.Info("resuming", "arch", o.arch, "file", file, "host", host, "offset", offset)
+	default:
+		offset = 0
+		slog.Info("fetched", "arch", o.arch, "file", file, "host", host)
+		if err := writeRangeValidator(part, resp.Header); err != nil {
+			return err
+		}
+	}
+
+	out, err := os.OpenFile(part, flags, 0640)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	body := o.cfg.limited(ctx, resp.Body)
+	if o.cfg.Progress != nil {
+		total := int64(-1)
+		if resp.ContentLength >= 0 {
+			total = offset + resp.ContentLength
+		}
+		body = &progress{
+			r:     body,
+			w:     o.cfg.Progress,
+			name:  file,
+			n:     offset,
+			total: total,
+			start: time.Now(),
+			last:  time.Now(),
+		}
+	}
+
+	n, err := io.Copy(out, body)
+	if err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// A short body leaves the part behind for the retry to resume.
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return fmt.Errorf("%q from %s: got %d bytes, expected %d", file, host, n, resp.ContentLength)
+	}
+
+	err = os.Rename(part, fp)
+	if err != nil {
+		return err
+	}
+	if err := removeValidators(part); err != nil {
+		return err
+	}
+	o.fetched(file, host)
+	if !o.cfg.Conditional {
+		return nil
+	}
+	return writeValidators(fp, resp.Header)
+}
+
+// validatorsFile is the sidecar a set's validators are kept in: the
+// ETag and Last-Modified -conditional sends for fp, or the If-Range a
+// part is resumed with.
+func validatorsFile(fp string) string {
+	return fp + ".validators"
+}
+
+// writeValidators saves the ETag and Last-Modified a mirror sent for
+// fp, or removes stale ones when it sent neither.
+func writeValidators(fp string, rh http.Header) error {
+	var b strings.Builder
+	if v := rh.Get("ETag"); v != "" {
+		fmt.Fprintf(&b, "If-None-Match: %s\n", v)
+	}
+	if v := rh.Get("Last-Modified"); v != "" {
+		fmt.Fprintf(&b, "If-Modified-Since: %s\n", v)
+	}
+	if b.Len() == 0 {
+		return removeValidators(fp)
+	}
+	return os.WriteFile(validatorsFile(fp), []byte(b.String()), 0640)
+}
+
+// writeRangeValidator saves the If-Range for resuming part: the ETag
+// the mirror sent, or its Last-Modified when the ETag is missing or
+// weak, which If-Range can't use. A mirror sending neither leaves the
+// part to be fetched again rather than resumed.
+func writeRangeValidator(part string, rh http.Header) error {
+	v := rh.Get("ETag")
+	if v == "" || strings.HasPrefix(v, "W/") {
+		v = rh.Get("Last-Modified")
+	}
+	if v == "" {
+		return removeValidators(part)
+	}
+	return os.WriteFile(validatorsFile(part), []byte("If-Range: "+v+"\n"), 0640)
+}
+
+func removeValidators(fp string) error {
+	err := os.Remove(validatorsFile(fp))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// readValidators adds the headers saved for fp to h, reporting whether
+// there were any. A missing or unreadable sidecar just means a full
+// download.
+func readValidators(fp string, h http.Header) bool {
+	b, err := os.ReadFile(validatorsFile(fp))
+	if err != nil {
+		return false
+	}
+	found := false
+	for _, line := range strings.Split(string(b), "\n") {
+		if k, v, ok := strings.Cut(line, ": "); ok {
+			h.Set(k, v)
+			found = true
+		}
+	}
+	return found
+}
+
+// progressInterval is how often progress reports a running download.
+const progressInterval = 5 * time.Second
+
+// progress reports how far a download has come to w every
+// progressInterval, so large sets don't look hung.
+type progress struct {
+	r     io.Reader
+	w     io.Writer
+	name  string
+	n     int64
+	total int64 // -1 when the size isn't known
+	read  int64 // bytes read by this request, for the rate
+	start time.Time
+	last  time.Time
+}
+
+func (p *progress) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	p.read += int64(n)
+	if time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		rate := float64(p.read) / time.Since(p.start).Seconds()
+		if p.total > 0 {
+			fmt.Fprintf(p.w, "\t%s: %s of %s (%d%%), %s/s\n", p.name, mib(p.n), mib(p.total),
+				p.n*100/p.total, mib(int64(rate)))
+		} else {
+			fmt.Fprintf(p.w, "\t%s: %s, %s/s\n", p.name, mib(p.n), mib(int64(rate)))
+		}
+	}
+	return n, err
+}
+
+func mib(n int64) string {
+	return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+}
@@ -0,0 +1,339 @@
+package goru
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckRelease(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		files []string
+		stale string // listed in the error, none when empty
+	}{
+		{"empty", nil, ""},
+		{"same release", []string{"base75.tgz", "miniroot75.img", "bsd", "SHA256"}, ""},
+		{"other release", []string{"base75.tgz", "base74.tgz", "comp74.tgz"}, "base74.tgz, comp74.tgz"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, f := range tc.files {
+				if err := os.WriteFile(path.Join(dir, f), nil, 0640); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := checkRelease(dir, "75")
+			switch {
+			case tc.stale == "" && err != nil:
+				t.Errorf("got %v, want no error", err)
+			case tc.stale != "" && (err == nil || !strings.Contains(err.Error(), "("+tc.stale+")")):
+				t.Errorf("got %v, want %s listed", err, tc.stale)
+			}
+		})
+	}
+}
+
+func TestParseIndex(t *testing.T) {
+	index := path.Join(t.TempDir(), "index.txt")
+	listing := `-rw-r--r--  1 1001  0   4558 Apr  5 12:00 BUILDINFO
+-rw-r--r--  1 1001  0   2138 Apr  5 12:00 SHA256
+-rw-r--r--  1 1001  0   1992 Apr  5 12:00 SHA256.sig
+-rw-r--r--  1 1001  0  26214 Apr  5 12:00 base75.tgz
+-rw-r--r--  1 1001  0  24806 Apr  5 12:00 bsd
+-rw-r--r--  1 1001  0  24930 Apr  5 12:00 bsd.mp
+-rw-r--r--  1 1001  0  45324 Apr  5 12:00 bsd.rd
+-rw-r--r--  1 1001  0   8192 Apr  5 12:00 cd75.iso
+-rw-r--r--  1 1001  0  58720 Apr  5 12:00 comp75.tgz
+-rw-r--r--  1 1001  0  48234 Apr  5 12:00 game75.tgz
+
+-rw-r--r--  1 1001  0  51200 Apr  5 12:00 miniroot75.img
+-rw-r--r--  1 1001  0  36120 Apr  5 12:00 xbase75.tgz
+`
+	if err := os.WriteFile(index, []byte(listing), 0640); err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := setList{"base75.tgz", "bsd", "bsd.mp", "bsd.rd", "comp75.tgz", "miniroot75.img", "xbase75.tgz"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := os.WriteFile(index, []byte("-rw-r--r--  1 1001  0  8192 Apr  5 12:00 cd75.iso\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseIndex(index); err == nil {
+		t.Error("parsed an index without sets")
+	}
+}
+
+// fakeMirror serves files for 7.5/amd64.
+type fakeMirror struct {
+	*httptest.Server
+	files map[string]string
+
+	mu     sync.Mutex
+	ranges map[string]string // the Range each file was last asked for with
+}
+
+func newFakeMirror(t *testing.T, files map[string]string) *fakeMirror {
+	t.Helper()
+	m := &fakeMirror{files: files, ranges: map[string]string{}}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file := strings.TrimPrefix(r.URL.Path, "/7.5/amd64/")
+		body, ok := m.files[file]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		m.mu.Lock()
+		m.ranges[file] = r.Header.Get("Range")
+		m.mu.Unlock()
+		w.Header().Set("ETag", etag(body))
+		http.ServeContent(w, r, file, time.Time{}, strings.NewReader(body))
+	}))
+	t.Cleanup(m.Close)
+	return m
+}
+
+// etag is the ETag the mirror sends for body.
+func etag(body string) string {
+	h := sha256.Sum256([]byte(body))
+	return `"` + hex.EncodeToString(h[:8]) + `"`
+}
+
+// releaseFiles are the sets served for 7.5/amd64, with an index.txt
+// and a SHA256 listing them all. bsd.mp is listed but not served.
+func releaseFiles() map[string]string {
+	files := map[string]string{
+		"bsd":        "kernel",
+		"bsd.rd":     "ramdisk kernel",
+		"base75.tgz": strings.Repeat("base set ", 1000),
+	}
+	var index, sums bytes.Buffer
+	names := []string{"bsd.mp"}
+	for file := range files {
+		names = append(names, file)
+	}
+	sort.Strings(names)
+	for _, file := range names {
+		fmt.Fprintf(&index, "-rw-r--r--  1 1001  0  %d Apr  5 12:00 %s\n", len(files[file]), file)
+		h := sha256.Sum256([]byte(files[file]))
+		fmt.Fprintf(&sums, "SHA256 (%s) = %s\n", file, hex.EncodeToString(h[:]))
+	}
+	files["index.txt"] = index.String()
+	files["SHA256"] = sums.String()
+	files["SHA256.sig"] = "untrusted comment: test\n"
+	return files
+}
+
+func fetchTest(t *testing.T, m *fakeMirror) (*OpenBSD, string) {
+	t.Helper()
+	cfg := &Config{
+		Client:   m.Client(),
+		Jobs:     2,
+		Retries:  1,
+		Mirrors:  []string{m.URL + "/%s/%s/%s"},
+		Optional: map[string]bool{},
+	}
+	return testOpenBSD(t, cfg, "amd64", "75"), t.TempDir()
+}
+
+func TestFetchSkipsMissingOptional(t *testing.T) {
+	m := newFakeMirror(t, releaseFiles())
+	o, dest := fetchTest(t, m)
+	o.cfg.Optional["bsd.mp"] = true
+
+	if err := o.Fetch(context.Background(), dest, "7.5", "75"); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range m.files {
+		got, err := os.ReadFile(path.Join(dest, "amd64", file))
+		if err != nil {
+			t.Error(err)
+		} else if string(got) != want {
+			t.Errorf("%s: got %q, want %q", file, got, want)
+		}
+	}
+	if _, err := os.Stat(path.Join(dest, "amd64", "bsd.mp")); !os.IsNotExist(err) {
+		t.Errorf("bsd.mp: got %v, want it missing", err)
+	}
+}
+
+func TestFetchMissingSet(t *testing.T) {
+	m := newFakeMirror(t, releaseFiles())
+	o, dest := fetchTest(t, m)
+
+	err := o.Fetch(context.Background(), dest, "7.5", "75")
+	if !errors.Is(err, ErrSetMissing) {
+		t.Fatalf("got %v, want %v", err, ErrSetMissing)
+	}
+}
+
+func TestFetchResumes(t *testing.T) {
+	base := releaseFiles()["base75.tgz"]
+	half := len(base) / 2
+	for _, tc := range []struct {
+		name      string
+		validator string // the part's saved If-Range, none when empty
+		part      string
+		wantRange string
+	}{
+		{"unchanged", "If-Range: " + etag(base), base[:half], fmt.Sprintf("bytes=%d-", half)},
+		// The mirror's copy changed since the part was fetched, so
+		// If-Range gets all of it.
+		{"changed", "If-Range: " + etag("old base set"), "old base set"[:6], fmt.Sprintf("bytes=%d-", 6)},
+		// Without a validator there's no telling, so it starts over.
+		{"no validator", "", base[:half], ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newFakeMirror(t, releaseFiles())
+			o, dest := fetchTest(t, m)
+			o.cfg.Optional["bsd.mp"] = true
+
+			outDir := path.Join(dest, "amd64")
+			if err := os.MkdirAll(outDir, 0750); err != nil {
+				t.Fatal(err)
+			}
+			part := path.Join(outDir, "base75.tgz.part")
+			if err := os.WriteFile(part, []byte(tc.part), 0640); err != nil {
+				t.Fatal(err)
+			}
+			if tc.validator != "" {
+				if err := os.WriteFile(validatorsFile(part), []byte(tc.validator+"\n"), 0640); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := o.Fetch(context.Background(), dest, "7.5", "75"); err != nil {
+				t.Fatal(err)
+			}
+			if got := m.ranges["base75.tgz"]; got != tc.wantRange {
+				t.Errorf("asked for range %q, want %q", got, tc.wantRange)
+			}
+			got, err := os.ReadFile(path.Join(outDir, "base75.tgz"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != base {
+				t.Errorf("base75.tgz doesn't match the mirror's")
+			}
+			if _, err := os.Stat(validatorsFile(part)); !os.IsNotExist(err) {
+				t.Errorf("the part's validator was left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestFetchSavesRangeValidator(t *testing.T) {
+	files := releaseFiles()
+	m := newFakeMirror(t, files)
+	o, dest := fetchTest(t, m)
+	// A mirror that drops the connection partway through a set
+	// leaves the part.
+	o.cfg.Client = &http.Client{Transport: truncating{m.Client().Transport, "base75.tgz"}}
+	o.cfg.Retries = 0
+	o.cfg.Optional["bsd.mp"] = true
+
+	if err := o.Fetch(context.Background(), dest, "7.5", "75"); err == nil {
+		t.Fatal("fetched despite the short bodies")
+	}
+	part := path.Join(dest, "amd64", "base75.tgz.part")
+	h := http.Header{}
+	if !readValidators(part, h) {
+		t.Fatalf("no validator saved for %s", part)
+	}
+	if got, want := h.Get("If-Range"), etag(files["base75.tgz"]); got != want {
+		t.Errorf("saved If-Range %q, want %q", got, want)
+	}
+}
+
+// truncating cuts the response body for file short.
+type truncating struct {
+	rt   http.RoundTripper
+	file string
+}
+
+func (t truncating) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(r)
+	if err != nil || path.Base(r.URL.Path) != t.file {
+		return resp, err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, 10), resp.Body}
+	return resp, nil
+}
+
+func TestVerifyCorruptSet(t *testing.T) {
+	files := releaseFiles()
+	// The mirror's SHA256 lists the real base75.tgz, what's served
+	// isn't it.
+	files["base75.tgz"] = strings.Repeat("corrupt! ", 1000)
+	m := newFakeMirror(t, files)
+	o, dest := fetchTest(t, m)
+	o.cfg.Optional["bsd.mp"] = true
+	o.cfg.SHA256Only = true
+
+	if err := o.Fetch(context.Background(), dest, "7.5", "75"); err != nil {
+		t.Fatal(err)
+	}
+	err := o.Verify(context.Background(), dest, "7.5", "75")
+	if !errors.Is(err, ErrChecksum) {
+		t.Fatalf("got %v, want %v", err, ErrChecksum)
+	}
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	stall := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/stall" {
+			<-stall
+		}
+	}))
+	defer s.Close()
+	defer close(stall)
+	c := NewClient(100*time.Millisecond, 2)
+
+	resp, err := c.Get(s.URL + "/stall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !errors.Is(err, errIdle) {
+		t.Errorf("stalled body: got %v, want %v", err, errIdle)
+	}
+
+	// A reader slower than the timeout, like one held back by the
+	// Limiter, isn't the mirror going idle.
+	resp, err = c.Get(s.URL + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	time.Sleep(300 * time.Millisecond)
+	if b, err := io.ReadAll(resp.Body); err != nil || string(b) != "partial" {
+		t.Errorf("slow reader: got %q, %v", b, err)
+	}
+}
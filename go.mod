@@ -1,17 +1,17 @@
 module github.com/qbit/goru
 
-go 1.19
+go 1.25.0
 
 require (
 	github.com/google/goexpect v0.0.0-20210430020637-ab937bf7fd6f
-	golang.org/x/term v0.3.0
+	golang.org/x/crypto v0.54.0
+	golang.org/x/time v0.5.0
+	google.golang.org/grpc v1.31.0
 )
 
 require (
 	github.com/golang/protobuf v1.3.3 // indirect
 	github.com/google/goterm v0.0.0-20190703233501-fc88cf888a3f // indirect
-	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de // indirect
-	golang.org/x/sys v0.3.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
 	google.golang.org/genproto v0.0.0-20190819201941-24fa4b261c55 // indirect
-	google.golang.org/grpc v1.31.0 // indirect
 )
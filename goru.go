@@ -0,0 +1,2017 @@
+package goru
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	expect "github.com/google/goexpect"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+)
+
+//go:embed autoinstall
+var aiFS embed.FS
+
+// DefaultDiskLayout is the default autopartitioning template, served to the
+// installer as /disklabel.
+const DefaultDiskLayout = `/	5G-*	95%
+swap	1G
+`
+
+// DefaultDiskSize is the size of the guest's disk in megabytes.
+const DefaultDiskSize = 10240
+
+// BSD in asci / 26 (the current # of years openbsd has been around)
+const DefaultPort = 25706
+
+// DefaultMirror is the default mirror. The placeholders are the release, the
+// arch and the file, in that order.
+var DefaultMirror = "https://cdn.openbsd.org/pub/OpenBSD/%s/%s/%s"
+
+// pubKeyURL is where release keys are fetched from when the host
+// doesn't have them in /etc/signify.
+var pubKeyURL = "https://raw.githubusercontent.com/openbsd/src/master/etc/signify/openbsd-%s-base.pub"
+
+// DefaultOptional are the sets that may be missing from a mirror
+// without failing the run when -optional isn't given.
+var DefaultOptional = []string{"bsd.mp"}
+
+// shutdownGrace is how long Build waits for requests in flight
+// before closing the server.
+const shutdownGrace = 5 * time.Second
+
+// diffWait is how long Build waits for the guest's diff upload once
+// the build steps are done.
+const diffWait = time.Minute
+
+// haltWait is how long Build waits for qemu to exit once the guest
+// is told to power off.
+const haltWait = 2 * time.Minute
+
+// DefaultPackages are installed in the guest when -packages isn't
+// given.
+var DefaultPackages = []string{"bash", "git", "go"}
+
+// ErrBootHang is returned when the guest doesn't make it to the
+// installer or back to a login prompt, which is worth retrying on a
+// fresh disk.
+var ErrBootHang = errors.New("guest hung while booting")
+
+// errNotFound is returned when no mirror has a file.
+var errNotFound = errors.New("not found on any mirror")
+
+// ErrUnsupported is returned by Build for arches qemu can't install.
+var ErrUnsupported = errors.New("can't be built under qemu")
+
+// ErrSetMissing is returned when a set that isn't optional can't be
+// found on any mirror, or is missing when verifying.
+var ErrSetMissing = errors.New("set missing")
+
+// ErrChecksum is returned when a set doesn't match its checksum or
+// signature.
+var ErrChecksum = errors.New("checksum mismatch")
+
+var archMap = map[string]string{
+	"arm64":   "arm64",
+	"amd64":   "amd64",
+	"i386":    "386",
+	"octeon":  "mips64",
+	"armv7":   "arm",
+	"riscv64": "riscv64",
+	// Go has no sparc64 port, so there's nothing to build for it.
+	"sparc64":     "",
+	"powerpc64":   "ppc64",
+	"loongarch64": "loong64",
+}
+
+// nwc writes the console to out, copying it to w if set.
+type nwc struct {
+	out, w io.Writer
+}
+
+func (n nwc) Write(p []byte) (int, error) {
+	n.out.Write(p)
+	if n.w != nil {
+		n.w.Write(p)
+	}
+	return len(p), nil
+}
+
+func (n nwc) Close() error {
+	return nil
+}
+
+type setList []string
+
+func newSetList(sv string) setList {
+	sl := setList{
+		"SHA256.sig",
+		"SHA256",
+
+		"bsd",
+		"bsd.mp",
+		"bsd.rd",
+		"index.txt",
+
+		"base%s.tgz",
+		"comp%s.tgz",
+		"man%s.tgz",
+		"xbase%s.tgz",
+		"miniroot%s.img",
+	}
+
+	for s := range sl {
+		if strings.Contains(sl[s], "%s") {
+			sl[s] = fmt.Sprintf(sl[s], sv)
+		}
+	}
+
+	return sl
+}
+
+// Runner runs host commands in dir, returning their combined output.
+type Runner interface {
+	Run(ctx context.Context, dir, name string, args ...string) ([]byte, error)
+}
+
+// ExecRunner runs commands on the host with os/exec.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, dir, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	return cmd.CombinedOutput()
+}
+
+// Config holds the settings shared by every arch in a run.
+type Config struct {
+	Client       *http.Client
+	Runner       Runner
+	Jobs         int
+	Retries      int
+	RetryDelay   time.Duration
+	Progress     io.Writer
+	Output       io.Writer
+	Port         int
+	BindAddr     string
+	HostAddr     string
+	Mirrors      []string
+	Optional     map[string]bool
+	CacheDir     string
+	GuestVerify  bool
+	StrictVerify bool
+	SHA256Only   bool
+	Verbose      bool
+	DryRun       bool
+	KeepDisk     bool
+	Snapshot     bool
+	BaseImage    bool
+	DiskSize     int
+	DiskFormat   string
+	DiskLayout   string
+	Force        bool
+	Conditional  bool
+	RNG          bool
+	Virtio       bool
+	QemuArgs     []string
+	NoAccel      bool
+	BIOS         map[string]*string
+	Disk         map[string]*string
+	Mem          map[string]*int
+	CPUs         map[string]*int
+	Kernel       map[string]*string
+	BootTimeout  time.Duration
+	BootRetries  int
+	Timezone     string
+	SSHD         bool
+	RootSSH      string
+	SSHPort      int
+	Locale       string
+	Guest        GuestSetup
+	Prompts      Prompts
+	Packages     []string
+	BootCmds     []string
+	Recipe       Recipe
+	Console      io.Writer
+	ConsoleLog   bool
+	DiffFile     *os.File
+	DiffPipe     string
+	OnSuccess    string
+	OnFailure    string
+	// Token has to start the path of every request to the server,
+	// see NewToken.
+	Token string
+	// Transport is how the diff gets back from the guest: http,
+	// posted by curl, or ssh, run over SSHPort as the guest user
+	// with SSHSigner.
+	Transport string
+	SSHSigner ssh.Signer
+	// Stages are the ones the subcommand runs: fetch, verify, and
+	// build or install and run.
+	Stages map[string]bool
+	// Limiter, when set, is shared by every download so they stay
+	// under its rate together, see NewLimiter.
+	Limiter *rate.Limiter
+	// ApplyTo is a golang.org/x/sys checkout each arch's diff is
+	// applied to once it's built, see CheckClean.
+	ApplyTo string
+	// InstallTimeout bounds the autoinstall, from answering the
+	// installer to it rebooting into the installed system.
+	InstallTimeout time.Duration
+
+	// port is the one the server is listening on, which differs from
+	// Port when that's 0.
+	port int
+}
+
+// OpenBSD is a Distro installing OpenBSD with autoinstall.
+type OpenBSD struct {
+	arch     string // arm64
+	pkgArch  string // aarch64
+	qemu     QemuArch
+	sets     setList
+	instScpt string
+	bios     string // firmware passed to qemu's -bios
+	kernel   string // loaded with qemu's -kernel
+	// fixedSets is set when sets came from -config and shouldn't be
+	// replaced with the ones in index.txt.
+	fixedSets bool
+	disk      string // install disk, wd0
+	cfg       *Config
+
+	// known is the manifest from an earlier fetch, fetchedFrom the
+	// mirrors this one downloaded from.
+	known       *Manifest
+	mu          sync.Mutex
+	fetchedFrom map[string]string
+}
+
+// Prompts are the regexps waited for on the guest's console.
+type Prompts struct {
+	Boot     string // the boot loader's, boot>
+	Login    string
+	Password string
+	Root     string // root's shell
+	User     string // the guest user's shell
+}
+
+// DefaultPrompts are the prompts of a guest installed with hostname.
+func DefaultPrompts(hostname string) Prompts {
+	h := regexp.QuoteMeta(hostname)
+	return Prompts{
+		Boot:     "boot>",
+		Login:    "login:",
+		Password: "Password:",
+		Root:     h + "#",
+		User:     h + `\$`,
+	}
+}
+
+// prompts are the Prompts set in the config, with the ones left empty
+// derived from the guest's hostname.
+func (c *Config) prompts() Prompts {
+	p := DefaultPrompts(c.Guest.Hostname)
+	override(&p.Boot, c.Prompts.Boot)
+	override(&p.Login, c.Prompts.Login)
+	override(&p.Password, c.Prompts.Password)
+	override(&p.Root, c.Prompts.Root)
+	override(&p.User, c.Prompts.User)
+	return p
+}
+
+// GuestSetup is how the installer sets up the guest's accounts and
+// which sets it installs.
+type GuestSetup struct {
+	Hostname string
+	User     string
+	FullName string
+	UserPass string
+	RootPass string
+	// SSHKey is an authorized_keys line for User, see ParseSSHKey.
+	SSHKey string
+	// Sets is the answer to the installer's set selection.
+	Sets string
+}
+
+var DefaultGuest = GuestSetup{
+	Hostname: "buildlet",
+	User:     "gopher",
+	FullName: "Gopher Gopherson",
+	UserPass: "gopher",
+	RootPass: "root",
+	Sets:     "+* -x* -game* -man* +xbase* done",
+}
+
+// responseData is what the autoinstall templates are rendered with.
+type responseData struct {
+	GuestSetup
+	// GuestVerify makes the installer refuse sets that lack a
+	// SHA256.sig instead of continuing without verification.
+	GuestVerify bool
+	Timezone    string
+	Disk        string
+	Iface       string
+	// Server is the host:port goru serves the sets and install
+	// files on, under Prefix.
+	Server string
+	Prefix string
+	// SSHD starts sshd on boot, RootSSH is one of yes, no or
+	// prohibit-password.
+	SSHD    bool
+	RootSSH string
+}
+
+func (o *OpenBSD) responseFile() (string, error) {
+	tmpl, err := template.New(o.arch).Parse(o.instScpt)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, responseData{
+		GuestSetup:  o.cfg.Guest,
+		GuestVerify: o.cfg.GuestVerify,
+		Timezone:    o.cfg.Timezone,
+		Disk:        o.disk,
+		Iface:       o.qemu.Iface,
+		Server:      o.cfg.guestServer(),
+		Prefix:      o.cfg.prefix(),
+		SSHD:        o.cfg.SSHD,
+		RootSSH:     o.cfg.RootSSH,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// ShellSafe are the characters that never need quoting.
+const ShellSafe = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+,.:/@%"
+
+// shellQuote renders args so they can be pasted into a POSIX shell.
+func shellQuote(args []string) string {
+	q := make([]string, len(args))
+	for i, a := range args {
+		if a != "" && strings.Trim(a, ShellSafe) == "" {
+			q[i] = a
+			continue
+		}
+		q[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return strings.Join(q, " ")
+}
+
+func isSigFile(file string) bool {
+	return file == "SHA256" || file == "SHA256.sig"
+}
+
+// pubKey returns the path to the base signify key for a release,
+// preferring the one installed on the host. Otherwise the key is
+// downloaded once into the cache dir and reused from there.
+func (o *OpenBSD) pubKey(ctx context.Context, smushVer string) (string, error) {
+	name := fmt.Sprintf("openbsd-%s-base.pub", smushVer)
+	sysKey := path.Join("/etc/signify", name)
+	if _, err := os.Stat(sysKey); err == nil {
+		return sysKey, nil
+	}
+
+	cached := path.Join(o.cfg.CacheDir, name)
+	if _, err := os.Stat(cached); err == nil {
+		return cached, nil
+	}
+
+	slog.Info("fetching", "arch", o.arch, "file", name)
+	key, err := o.fetchKey(ctx, smushVer)
+	if err != nil {
+		return "", fmt.Errorf("can't get %q, install it in /etc/signify or %s: %w",
+			name, o.cfg.CacheDir, err)
+	}
+
+	err = os.MkdirAll(o.cfg.CacheDir, 0750)
+	if err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	err = os.WriteFile(cached, key, 0640)
+	if err != nil {
+		return "", err
+	}
+
+	return cached, nil
+}
+
+func (o *OpenBSD) fetchKey(ctx context.Context, smushVer string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(pubKeyURL, smushVer), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	key, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(key, []byte("untrusted comment: ")) {
+		return nil, errors.New("not a signify key")
+	}
+	return key, nil
+}
+
+// sumLine matches the lines of a SHA256 file, "SHA256 (bsd) = <hex>".
+var sumLine = regexp.MustCompile(`^SHA256 \((.+)\) = ([0-9a-f]{64})$`)
+
+// readSums parses a SHA256 file into file name to hex digest.
+func readSums(file string) (map[string]string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	sums := map[string]string{}
+	for _, l := range strings.Split(string(b), "\n") {
+		if m := sumLine.FindStringSubmatch(l); m != nil {
+			sums[m[1]] = m[2]
+		}
+	}
+	return sums, nil
+}
+
+// checkSum compares the SHA-256 of file against the one listed in sums.
+func checkSum(sums map[string]string, dir, file string) error {
+	want, ok := sums[file]
+	if !ok {
+		return fmt.Errorf("%q isn't listed in SHA256: %w", file, ErrChecksum)
+	}
+
+	f, err := os.Open(path.Join(dir, file))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("%w for %q: expected %s, got %s", ErrChecksum, file, want, got)
+	}
+	return nil
+}
+
+func (o *OpenBSD) Arch() string {
+	return o.arch
+}
+
+// Tools lists the host binaries needed for the stages being run.
+// Without -strict-verify signify is optional, Verify falls back to
+// just checking SHA256.
+func (o *OpenBSD) Tools() []string {
+	run := o.cfg.Stages
+	var tools []string
+	if run["verify"] && !o.cfg.SHA256Only {
+		tools = append(tools, signifyBin())
+	}
+	if o.cfg.boots() && o.qemu.Unsupported == "" {
+		tools = append(tools, "qemu-img", "dd", o.qemu.Binary)
+	}
+	return tools
+}
+
+// signifyBin is the signify implementation used on this host.
+func signifyBin() string {
+	if runtime.GOOS != "openbsd" {
+		return "gosignify"
+	}
+	return "signify"
+}
+
+func (o *OpenBSD) Verify(ctx context.Context, dest, ver, smushVer string) error {
+	// Sets fetched by an earlier run are listed in their index.txt.
+	o.useIndex(path.Join(dest, o.arch))
+	if o.cfg.DryRun {
+		o.dryVerify()
+		return nil
+	}
+
+	sig := signifyBin()
+	outDir := path.Join(dest, o.arch)
+
+	sums, err := readSums(path.Join(outDir, "SHA256"))
+	if err != nil {
+		return err
+	}
+
+	// The plain SHA256 still catches corrupt downloads, but it comes
+	// from the same mirror as the sets, so only signify vouches for
+	// them. Going without it has to be asked for.
+	pub := ""
+	if o.cfg.SHA256Only {
+		slog.Info("only checking SHA256", "arch", o.arch, "skipped", sig)
+	} else {
+		if _, err := exec.LookPath(sig); err != nil {
+			return fmt.Errorf("%s not found, install it or pass -sha256-only: %w", sig, err)
+		}
+		pub, err = o.pubKey(ctx, smushVer)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The manifest records how each set verified. Sets are also
+	// checked against it, catching ones changed since they were
+	// fetched.
+	m, err := ReadManifest(outDir)
+	if err != nil {
+		m = &Manifest{Release: ver, Arch: o.arch}
+	}
+	defer func() {
+		if err := m.write(outDir); err != nil {
+			slog.Warn("can't write the manifest", "arch", o.arch, "err", err)
+		}
+	}()
+
+	var missing, failed []string
+	for _, file := range o.sets {
+		fi, err := os.Stat(path.Join(outDir, file))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			if o.cfg.StrictVerify && !o.cfg.Optional[file] {
+				missing = append(missing, file)
+			}
+			continue
+		}
+		if isSigFile(file) || file == "index.txt" {
+			continue
+		}
+		slog.Info("verifying", "arch", o.arch, "file", file)
+		err = checkSum(sums, outDir, file)
+		e := m.entry(file)
+		if err == nil && e != nil && e.SHA256 != sums[file] {
+			err = fmt.Errorf("%w: %q changed since it was fetched", ErrChecksum, file)
+		}
+		if err == nil && pub != "" {
+			out, cErr := o.cfg.Runner.Run(ctx, outDir,
+				sig,
+				"-C",
+				"-p",
+				pub,
+				"-x",
+				"SHA256.sig",
+				file,
+			)
+			if cErr != nil {
+				err = fmt.Errorf("%w: signify rejected %q: %w\n%s", ErrChecksum, file, cErr, out)
+			}
+		}
+		if e == nil {
+			m.Files = append(m.Files, ManifestEntry{File: file, Size: fi.Size()})
+			e = &m.Files[len(m.Files)-1]
+			if err == nil {
+				e.SHA256 = sums[file]
+			}
+		}
+		switch {
+		case err != nil:
+			e.Verified = "failed"
+		case pub != "":
+			e.Verified = "signify"
+		default:
+			e.Verified = "sha256"
+		}
+		if err != nil {
+			if !o.cfg.StrictVerify {
+				return fmt.Errorf("verify %s/%s: %w", o.arch, file, err)
+			}
+			slog.Error("verify failed", "arch", o.arch, "file", file, "err", err)
+			failed = append(failed, file)
+		}
+
+	}
+	if len(missing) > 0 || len(failed) > 0 {
+		sentinel := ErrChecksum
+		if len(missing) > 0 {
+			sentinel = ErrSetMissing
+		}
+		return fmt.Errorf("strict verification failed for %s: missing [%s], unverified [%s]: %w",
+			o.arch, strings.Join(missing, " "), strings.Join(failed, " "), sentinel)
+	}
+	return nil
+}
+
+// NewToken makes a random Token for a run.
+func NewToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// prefix is the path every request to the server starts with.
+func (c *Config) prefix() string {
+	if c.Token == "" {
+		return ""
+	}
+	return "/" + c.Token
+}
+
+// requireToken strips the token from requests to h, refusing the ones
+// without it.
+func (c *Config) requireToken(h http.Handler) http.Handler {
+	if c.Token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tok, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(c.Token)) != 1 {
+			slog.Warn("request without the token", "remote", r.RemoteAddr, "path", r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		r.URL.Path = "/" + rest
+		r.URL.RawPath = ""
+		h.ServeHTTP(w, r)
+	})
+}
+
+// guestServer is the address the guest reaches the http server on.
+// Everything handed to the guest is built from it.
+func (c *Config) guestServer() string {
+	port := c.Port
+	if c.port != 0 {
+		port = c.port
+	}
+	return net.JoinHostPort(c.HostAddr, strconv.Itoa(port))
+}
+
+// streamDiff passes a received diff on to -diff-fd or -diff-pipe.
+func (c *Config) streamDiff(diff []byte) error {
+	if c.DiffFile != nil {
+		_, err := c.DiffFile.Write(diff)
+		return err
+	}
+	if c.DiffPipe == "" {
+		return nil
+	}
+
+	// Opening a fifo waits for a reader, which would hold up the
+	// guest's upload, so it's opened non-blocking and the diff is
+	// skipped while nothing is reading.
+	out, err := os.OpenFile(c.DiffPipe, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if errors.Is(err, syscall.ENXIO) {
+		return fmt.Errorf("nothing is reading %s", c.DiffPipe)
+	}
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = out.Write(diff)
+	return err
+}
+
+// handler serves the autoinstall files and sets to the guest and
+// stores the diff it posts back in outDir. The outcome of each upload
+// is sent on received if there's room.
+func (o *OpenBSD) handler(outDir, instConf string, received chan<- error) http.Handler {
+	fileServer := http.FileServer(http.Dir(outDir))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			if r.URL.Path == "/disklabel" {
+				fmt.Fprint(w, o.cfg.DiskLayout)
+				return
+			}
+			if r.URL.Path == "/install.conf" {
+				fmt.Fprint(w, instConf)
+				return
+			}
+			if strings.HasPrefix(r.URL.Path, "/pub") {
+				r.URL.Path = strings.Replace(r.URL.Path, "/pub", "/", 1)
+				// Without the signatures the installer falls back to
+				// asking if it should continue unverified.
+				if !o.cfg.GuestVerify && isSigFile(path.Base(r.URL.Path)) {
+					http.NotFound(w, r)
+					return
+				}
+				fileServer.ServeHTTP(w, r)
+				return
+			}
+			slog.Warn("unexpected request", "arch", o.arch, "path", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method == "POST" {
+			o.cfg.receiveDiff(w, r, outDir, o.arch, received)
+		}
+	})
+
+	return mux
+}
+
+// receiveDiff saves the base64 encoded diff the arch's guest posts,
+// signalling received once it's been decoded.
+func (c *Config) receiveDiff(w http.ResponseWriter, r *http.Request, outDir, arch string, received chan<- error) {
+	b64, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body",
+			http.StatusInternalServerError)
+		return
+	}
+
+	if a := r.URL.Query().Get("arch"); a != "" && a != arch {
+		http.Error(w, fmt.Sprintf("expected a diff for %s, not %s", arch, a),
+			http.StatusBadRequest)
+		return
+	}
+
+	// The encoded diff is kept to look into decoding problems.
+	err = os.WriteFile(path.Join(outDir, DiffName(arch)+".b64"), b64, 0640)
+	if err != nil {
+		http.Error(w, "Error writing request body",
+			http.StatusInternalServerError)
+		return
+	}
+
+	diff, err := base64.StdEncoding.DecodeString(string(b64))
+	if err != nil {
+		err = fmt.Errorf("can't decode the diff from the %s guest: %w", arch, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if err = c.saveDiff(outDir, arch, diff); err != nil {
+		http.Error(w, "Error writing diff",
+			http.StatusInternalServerError)
+	}
+
+	select {
+	case received <- err:
+	default:
+	}
+}
+
+// uploadSteps runs capture in the guest and posts its output to the
+// server base64 encoded, the http transport's way of getting the diff.
+func (c *Config) uploadSteps(capture, arch, prompt string) []expect.Batcher {
+	return []expect.Batcher{
+		&expect.BSnd{S: capture + " | openssl enc -base64 >/tmp/sys.diff.b64\n"},
+		&expect.BExp{R: prompt},
+		&expect.BSnd{S: fmt.Sprintf("curl -d @/tmp/sys.diff.b64 'http://%s%s/?arch=%s'\n", c.guestServer(), c.prefix(), arch)},
+		&expect.BExp{R: prompt},
+	}
+}
+
+// awaitDiff returns a runGuest collect function waiting for the diff
+// the guest posts to receiveDiff. The batch only waits for curl to be
+// started.
+func awaitDiff(arch string, received <-chan error) func(context.Context) error {
+	return func(ctx context.Context) error {
+		select {
+		case err := <-received:
+			return err
+		case <-time.After(diffWait):
+			return fmt.Errorf("no diff received from the %s guest after %s", arch, diffWait)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// saveDiff writes the arch's diff to outDir and passes it on to
+// -diff-fd or -diff-pipe.
+func (c *Config) saveDiff(outDir, arch string, diff []byte) error {
+	if err := os.WriteFile(path.Join(outDir, DiffName(arch)), diff, 0640); err != nil {
+		return err
+	}
+	if err := c.streamDiff(diff); err != nil {
+		slog.Error("can't stream diff", "arch", arch, "err", err)
+	}
+	return nil
+}
+
+// consoleLog is the file -console-log keeps the guest's console in.
+const consoleLog = "console.log"
+
+// DiffName is the file an arch's diff is saved as, with the encoded
+// upload next to it with .b64 added.
+func DiffName(arch string) string {
+	return fmt.Sprintf("sys.%s.diff", arch)
+}
+
+// reportDiff says whether the guest sent back any changes. Steps that
+// fail in the guest abort the build, so an empty diff here means the
+// generated files are unchanged.
+func reportDiff(outDir, arch string) error {
+	diff, err := os.ReadFile(path.Join(outDir, DiffName(arch)))
+	if err != nil {
+		return fmt.Errorf("no diff received from the %s guest: %w", arch, err)
+	}
+	if st := ParseDiffStat(diff); st.Empty {
+		slog.Warn("empty diff, unchanged unless the recipe quietly did nothing", "arch", arch)
+	} else {
+		slog.Info("diff received", "arch", arch, "stat", st.String())
+	}
+	return nil
+}
+
+// out is where the guest's console and the -dry-run plan are
+// written, nowhere when Output isn't set.
+func (c *Config) out() io.Writer {
+	if c.Output == nil {
+		return io.Discard
+	}
+	return c.Output
+}
+
+// diskFile is the name of the guest's disk image.
+func (c *Config) diskFile() string {
+	return "disk." + c.DiskFormat
+}
+
+// overlayFile is the disk booted with -base-image. It's recreated on
+// top of the base image every run, so changes made by a build never
+// outlive it.
+const overlayFile = "overlay.qcow2"
+
+// baseFile is the name of the installed disk image kept with
+// -base-image.
+func (c *Config) baseFile() string {
+	return "base." + c.DiskFormat
+}
+
+// boots reports whether the stages being run boot a guest.
+func (c *Config) boots() bool {
+	return c.Stages["build"] || c.Stages["install"] || c.Stages["run"]
+}
+
+// installedDisk returns the disk Run boots in outDir: a fresh overlay
+// of the base image with BaseImage, otherwise the disk Install left.
+func (c *Config) installedDisk(ctx context.Context, outDir string) (string, string, error) {
+	if c.BaseImage {
+		base := c.baseFile()
+		if _, err := os.Stat(path.Join(outDir, base)); err != nil {
+			return "", "", fmt.Errorf("no installed %s, run install first: %w", base, err)
+		}
+		slog.Info("booting an overlay", "arch", path.Base(outDir), "file", base)
+		if err := c.createOverlay(ctx, outDir); err != nil {
+			return "", "", err
+		}
+		return path.Join(outDir, overlayFile), "qcow2", nil
+	}
+	disk := path.Join(outDir, c.diskFile())
+	if _, err := os.Stat(disk); err != nil {
+		return "", "", fmt.Errorf("no installed %s, run install first: %w", c.diskFile(), err)
+	}
+	slog.Info("reusing the installed disk", "arch", path.Base(outDir), "file", c.diskFile())
+	return disk, c.DiskFormat, nil
+}
+
+// createOverlay makes a fresh overlay of the base image in outDir.
+func (c *Config) createOverlay(ctx context.Context, outDir string) error {
+	cmd := []string{"qemu-img", "create", "-f", "qcow2",
+		"-b", c.baseFile(), "-F", c.DiskFormat, overlayFile}
+	if out, err := c.Runner.Run(ctx, outDir, cmd[0], cmd[1:]...); err != nil {
+		return fmt.Errorf("couldn't create %s: %s: %s\n%s",
+			overlayFile, shellQuote(cmd), err, out)
+	}
+	return nil
+}
+
+// diskCmds are the commands creating the disk image from miniroot.
+func (o *OpenBSD) diskCmds(miniroot string) [][]string {
+	diskFile := o.cfg.diskFile()
+	size := fmt.Sprintf("%dM", o.cfg.DiskSize)
+	// A qcow2 image can't be written to with dd, so it starts out
+	// as a copy of the miniroot and grows to size.
+	if o.cfg.DiskFormat == "qcow2" {
+		return [][]string{
+			{"qemu-img", "convert", "-f", "raw", "-O", "qcow2", miniroot, diskFile},
+			{"qemu-img", "resize", "-f", "qcow2", diskFile, size},
+		}
+	}
+	return [][]string{
+		{"qemu-img", "create", "-f", "raw", "-o", "preallocation=full", diskFile, size},
+		{"dd", "conv=notrunc", "if=" + miniroot, "of=" + diskFile},
+	}
+}
+
+// createDisk makes a fresh disk image in outDir with the miniroot
+// written to the start of it.
+func (o *OpenBSD) createDisk(ctx context.Context, outDir, smushVer string) error {
+	diskFile := o.cfg.diskFile()
+	miniroot := fmt.Sprintf("miniroot%s.img", smushVer)
+	if _, err := os.Stat(path.Join(outDir, miniroot)); err != nil {
+		return fmt.Errorf("can't write miniroot to %s: %w", diskFile, err)
+	}
+	if err := checkSpace(outDir, o.cfg.imageNeeds(outDir), diskFile); err != nil {
+		return err
+	}
+
+	for _, c := range o.diskCmds(miniroot) {
+		if out, err := o.cfg.Runner.Run(ctx, outDir, c[0], c[1:]...); err != nil {
+			return fmt.Errorf("couldn't write %s to %s: %s: %s\n%s",
+				miniroot, diskFile, shellQuote(c), err, out)
+		}
+	}
+
+	return nil
+}
+
+// accelerator returns the qemu accelerator that can run the arch's
+// guest natively on this host, or "" when it has to be emulated.
+func accelerator(arch string) string {
+	goarch := archMap[arch]
+	if goarch != runtime.GOARCH && !(goarch == "386" && runtime.GOARCH == "amd64") {
+		return ""
+	}
+	switch runtime.GOOS {
+	case "linux":
+		f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+		if err != nil {
+			return ""
+		}
+		f.Close()
+		return "kvm"
+	case "darwin":
+		out, err := exec.Command("sysctl", "-n", "kern.hv_support").Output()
+		if err != nil || strings.TrimSpace(string(out)) != "1" {
+			return ""
+		}
+		return "hvf"
+	}
+	return ""
+}
+
+// qemuArgs builds the qemu command for the arch with its disk and the
+// optional devices enabled for this run.
+func (o *OpenBSD) qemuArgs(disk, format string) []string {
+	return o.cfg.qemuCmd(o.arch, o.qemu, o.bios, o.kernel, disk, format)
+}
+
+// qemuCmd is the qemu command running arch's guest from disk, an image
+// in format.
+func (c *Config) qemuCmd(arch string, q QemuArch, bios, kernel, disk, format string) []string {
+	args := []string{q.Binary, "-nographic"}
+	if q.Machine != "" {
+		args = append(args, "-machine", q.Machine)
+	}
+	if a := accelerator(arch); a != "" && !c.NoAccel {
+		args = append(args, "-accel", a, "-cpu", "host")
+	} else if q.CPU != "" {
+		args = append(args, "-cpu", q.CPU)
+	}
+	args = append(args, "-m", strconv.Itoa(q.MemMB))
+	if q.CPUs > 1 {
+		args = append(args, "-smp", strconv.Itoa(q.CPUs))
+	}
+	user := "user"
+	if c.SSHPort > 0 {
+		user += fmt.Sprintf(",hostfwd=tcp:127.0.0.1:%d-:22", c.SSHPort)
+	}
+	args = append(args,
+		"-net", "nic,model="+q.NIC,
+		"-net", user,
+	)
+	if bios != "" {
+		args = append(args, "-bios", bios)
+	}
+	if kernel != "" {
+		args = append(args, "-kernel", kernel)
+	}
+	drive := fmt.Sprintf("file=%s,format=%s", disk, format)
+	if q.DiskIf != "" {
+		drive += ",if=" + q.DiskIf
+	}
+	args = append(args, "-drive", drive)
+	if c.RNG {
+		args = append(args,
+			"-object", "rng-random,filename=/dev/urandom,id=rng0",
+			"-device", "virtio-rng-pci,rng=rng0",
+		)
+	}
+	if c.Snapshot {
+		args = append(args, "-snapshot")
+	}
+	return append(args, c.QemuArgs...)
+}
+
+// Build installs a fresh disk and runs the recipe in the same boot,
+// or boots an installed one with BaseImage, KeepDisk or Snapshot.
+func (o *OpenBSD) Build(ctx context.Context, dest, ver, smushVer string) error {
+	if o.qemu.Unsupported != "" {
+		return fmt.Errorf("%s %w: %s", o.arch, ErrUnsupported, o.qemu.Unsupported)
+	}
+	outDir := path.Join(dest, o.arch)
+
+	if o.cfg.DryRun {
+		instConf, err := o.responseFile()
+		if err != nil {
+			return err
+		}
+		o.dryBuild(dest, smushVer, instConf)
+		return nil
+	}
+
+	received, stop, err := o.prepare(outDir)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	diskFile := o.cfg.diskFile()
+	disk := path.Join(outDir, diskFile)
+	switch _, err := os.Stat(disk); {
+	case o.cfg.BaseImage:
+		if _, err := os.Stat(path.Join(outDir, o.cfg.baseFile())); err != nil {
+			if err := o.install(ctx, outDir, smushVer); err != nil {
+				return err
+			}
+		}
+		return o.run(ctx, outDir, received)
+	case err == nil && (o.cfg.KeepDisk || o.cfg.Snapshot):
+		return o.run(ctx, outDir, received)
+	case o.cfg.Snapshot:
+		return fmt.Errorf("-snapshot needs an installed %s: %w", diskFile, err)
+	}
+
+	if err := o.createDisk(ctx, outDir, smushVer); err != nil {
+		return err
+	}
+	return o.boot(ctx, outDir, disk, o.cfg.DiskFormat, false, received)
+}
+
+// Install autoinstalls a fresh disk, or the base image with BaseImage,
+// and powers the guest off once the packages are added. Run boots it
+// for the recipe.
+func (o *OpenBSD) Install(ctx context.Context, dest, ver, smushVer string) error {
+	if o.qemu.Unsupported != "" {
+		return fmt.Errorf("%s %w: %s", o.arch, ErrUnsupported, o.qemu.Unsupported)
+	}
+	outDir := path.Join(dest, o.arch)
+
+	if o.cfg.DryRun {
+		instConf, err := o.responseFile()
+		if err != nil {
+			return err
+		}
+		o.dryInstall(dest, smushVer, instConf)
+		return nil
+	}
+
+	_, stop, err := o.prepare(outDir)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	return o.install(ctx, outDir, smushVer)
+}
+
+// Run boots the disk Install left and runs the recipe, so a failed
+// run can be retried without installing again.
+func (o *OpenBSD) Run(ctx context.Context, dest, ver, smushVer string) error {
+	if o.qemu.Unsupported != "" {
+		return fmt.Errorf("%s %w: %s", o.arch, ErrUnsupported, o.qemu.Unsupported)
+	}
+	outDir := path.Join(dest, o.arch)
+
+	if o.cfg.DryRun {
+		o.dryRun(dest)
+		return nil
+	}
+
+	received, stop, err := o.prepare(outDir)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	return o.run(ctx, outDir, received)
+}
+
+// prepare starts the server the guest talks to, returning the channel
+// the diff upload is signalled on and a function stopping it.
+func (o *OpenBSD) prepare(outDir string) (chan error, func(), error) {
+	// The response file needs the port the server got.
+	l, err := o.cfg.listen()
+	if err != nil {
+		return nil, nil, err
+	}
+	instConf, err := o.responseFile()
+	if err != nil {
+		l.Close()
+		return nil, nil, err
+	}
+
+	// This serves the various files over http for use with autoinstall
+	received := make(chan error, 1)
+	stop := o.cfg.serve(l, o.handler(outDir, instConf, received))
+
+	if err := removeStale(outDir, o.arch); err != nil {
+		stop()
+		return nil, nil, err
+	}
+	if err := o.checkBoot(); err != nil {
+		stop()
+		return nil, nil, err
+	}
+	return received, stop, nil
+}
+
+// install autoinstalls a fresh disk and powers the guest off once the
+// packages are added, leaving the recipe for later boots. With
+// BaseImage the disk becomes the base image.
+func (o *OpenBSD) install(ctx context.Context, outDir, smushVer string) error {
+	disk := path.Join(outDir, o.cfg.diskFile())
+	if o.cfg.BaseImage {
+		slog.Info("installing", "arch", o.arch, "file", o.cfg.baseFile())
+	}
+	if err := o.createDisk(ctx, outDir, smushVer); err != nil {
+		return err
+	}
+	qemuArgs := o.qemuArgs(disk, o.cfg.DiskFormat)
+	if o.cfg.Verbose {
+		slog.Info("running qemu", "arch", o.arch, "cmd", shellQuote(qemuArgs))
+	}
+	phases, halt, err := o.batch(false, true)
+	if err != nil {
+		return err
+	}
+	if err := o.cfg.runGuest(ctx, outDir, o.arch, qemuArgs, phases, halt, nil); err != nil {
+		return err
+	}
+	if o.cfg.BaseImage {
+		return os.Rename(disk, path.Join(outDir, o.cfg.baseFile()))
+	}
+	return nil
+}
+
+// run boots the installed disk and runs the recipe.
+func (o *OpenBSD) run(ctx context.Context, outDir string, received <-chan error) error {
+	disk, format, err := o.cfg.installedDisk(ctx, outDir)
+	if err != nil {
+		return err
+	}
+	if err := o.cfg.checkInstalledImage(ctx, disk, format); err != nil {
+		return err
+	}
+	return o.boot(ctx, outDir, disk, format, true, received)
+}
+
+// boot runs the recipe in the guest booted from disk, autoinstalling
+// it first unless it's kept from an earlier install.
+func (o *OpenBSD) boot(ctx context.Context, outDir, disk, format string, kept bool, received <-chan error) error {
+	qemuArgs := o.qemuArgs(disk, format)
+	if o.cfg.Verbose {
+		slog.Info("running qemu", "arch", o.arch, "cmd", shellQuote(qemuArgs))
+	}
+	phases, halt, err := o.batch(kept, false)
+	if err != nil {
+		return err
+	}
+	collect := awaitDiff(o.arch, received)
+	if o.cfg.Transport == "ssh" {
+		capture, err := o.cfg.Recipe.capture(o.recipeData())
+		if err != nil {
+			return err
+		}
+		collect = o.cfg.sshDiff(outDir, o.arch, capture)
+	}
+	return o.cfg.runGuest(ctx, outDir, o.arch, qemuArgs, phases, halt, collect)
+}
+
+// checkBoot makes sure the firmware and boot loader qemu is given
+// exist.
+func (o *OpenBSD) checkBoot() error {
+	if o.bios != "" {
+		if _, err := os.Stat(o.bios); err != nil {
+			return fmt.Errorf("firmware for %s not found, set it with -%s-bios: %s",
+				o.arch, o.arch, err)
+		}
+	}
+	if o.kernel != "" {
+		if _, err := os.Stat(o.kernel); err != nil {
+			return fmt.Errorf("boot loader for %s not found, set it with -%s-kernel: %s",
+				o.arch, o.arch, err)
+		}
+	}
+	return nil
+}
+
+// recipeData is what the recipe is rendered with in the arch's guest.
+func (o *OpenBSD) recipeData() recipeData {
+	return recipeData{
+		Arch:   o.arch,
+		GOOS:   "openbsd",
+		GOARCH: archMap[o.arch],
+	}
+}
+
+// phase is one stretch of a guest's console dialogue. Steps without a
+// timeout of their own wait up to timeout, and timing out in the first
+// bootSteps steps means the guest hung booting.
+type phase struct {
+	name      string
+	batch     []expect.Batcher
+	timeout   time.Duration
+	bootSteps int
+}
+
+// stepWait is how long a build step waits for the guest's prompt.
+const stepWait = 30 * time.Minute
+
+// bootLoader answers the boot loader's prompt, sending the console to
+// com0 and running BootCmds before booting.
+func (o *OpenBSD) bootLoader(p Prompts) []expect.Batcher {
+	bootSecs := int(o.cfg.BootTimeout.Seconds())
+	batch := []expect.Batcher{
+		&expect.BExpT{R: p.Boot + "$", T: bootSecs},
+		&expect.BSnd{S: "set tty com0\n"},
+		&expect.BExpT{R: p.Boot, T: bootSecs},
+	}
+	for _, c := range o.cfg.BootCmds {
+		batch = append(batch,
+			&expect.BSnd{S: c + "\n"},
+			&expect.BExpT{R: p.Boot, T: bootSecs},
+		)
+	}
+	return append(batch, &expect.BSnd{S: "\n"})
+}
+
+// batch is the console dialogue for one boot of the guest, along with
+// the steps powering it off. A disk that isn't kept is autoinstalled
+// in an install phase first, which ends when the installer reboots
+// the guest into the installed system. With installOnly the guest is
+// powered off once the packages are added instead of running the
+// recipe.
+func (o *OpenBSD) batch(kept, installOnly bool) ([]phase, []expect.Batcher, error) {
+	p := o.cfg.prompts()
+	bootSecs := int(o.cfg.BootTimeout.Seconds())
+
+	var phases []phase
+	if !kept {
+		installed := append([]expect.Caser{
+			&expect.Case{R: regexp.MustCompile("CONGRATULATIONS"), T: expect.OK()},
+		}, failOn(installFailures)...)
+		if o.cfg.GuestVerify {
+			// The installer answers "no" to continuing unverified, so
+			// catch it here rather than waiting out the timeout.
+			installed = append(installed, &expect.Case{
+				R: regexp.MustCompile("does not contain SHA256.sig"),
+				T: expect.Fail(expect.NewStatus(codes.FailedPrecondition,
+					"installer could not find SHA256.sig for the sets")),
+			})
+		}
+		install := append(o.bootLoader(p),
+			&expect.BExpT{R: "utoinstall or", T: bootSecs})
+		bootSteps := len(install)
+		install = append(install,
+			&expect.BSnd{S: "a\n"},
+			&expect.BExp{R: "Response file"},
+			&expect.BSnd{S: fmt.Sprintf("http://%s%s/install.conf\n", o.cfg.guestServer(), o.cfg.prefix())},
+			&expect.BCas{C: installed},
+		)
+		phases = append(phases, phase{
+			name:      "install",
+			batch:     install,
+			timeout:   o.cfg.InstallTimeout,
+			bootSteps: bootSteps,
+		})
+	}
+
+	// The installer reboots into the installed system, which comes
+	// back to the boot loader like a kept disk does.
+	g := o.cfg.Guest
+	rootPrompt, userPrompt := p.Root, p.User
+	root, err := regexp.Compile(rootPrompt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad root prompt: %w", err)
+	}
+	batch := append(o.bootLoader(p), &expect.BExpT{R: p.Login, T: bootSecs})
+	bootSteps := len(batch)
+	batch = append(batch,
+		&expect.BSnd{S: "root\n"},
+		&expect.BExp{R: p.Password},
+		&expect.BSnd{S: g.RootPass + "\n"},
+		&expect.BCas{C: append([]expect.Caser{
+			&expect.Case{R: root, T: expect.OK()},
+		}, failOn(loginFailures)...)},
+	)
+	batch = append(batch, checked("packages",
+		fmt.Sprintf("env PKG_PATH=http://cdn.openbsd.org/%%m pkg_add %s",
+			strings.Join(o.cfg.Packages, " ")), rootPrompt)...)
+	halt := []expect.Batcher{&expect.BSnd{S: "halt -p\n"}}
+	if !installOnly {
+		batch = append(batch,
+			&expect.BSnd{S: fmt.Sprintf("su - %s\n", g.User)},
+			&expect.BExp{R: userPrompt},
+		)
+		if o.cfg.Locale != "" {
+			batch = append(batch,
+				&expect.BSnd{S: fmt.Sprintf("export LC_ALL=%s\n", o.cfg.Locale)},
+				&expect.BExp{R: userPrompt},
+			)
+		}
+		steps, err := o.cfg.Recipe.steps(o.recipeData(), userPrompt)
+		if err != nil {
+			return nil, nil, err
+		}
+		batch = append(batch, steps...)
+		if o.cfg.Transport != "ssh" {
+			capture, err := o.cfg.Recipe.capture(o.recipeData())
+			if err != nil {
+				return nil, nil, err
+			}
+			batch = append(batch, o.cfg.uploadSteps(capture, o.arch, userPrompt)...)
+		}
+		halt = append([]expect.Batcher{
+			&expect.BSnd{S: "exit\n"},
+			&expect.BExp{R: rootPrompt},
+		}, halt...)
+	}
+	phases = append(phases, phase{
+		name:      "run",
+		batch:     batch,
+		timeout:   stepWait,
+		bootSteps: bootSteps,
+	})
+	return phases, halt, nil
+}
+
+// runGuest boots qemuArgs and runs each phase in turn against the
+// guest's console, then has collect get the diff before powering the
+// guest off with halt. A nil collect means the boot produces no diff.
+// Timing out in a phase's boot steps is reported as ErrBootHang.
+func (c *Config) runGuest(ctx context.Context, outDir, arch string, qemuArgs []string, phases []phase, halt []expect.Batcher, collect func(context.Context) error) error {
+	console := c.Console
+	if c.ConsoleLog {
+		// Unbuffered, so the log is complete however Build returns,
+		// and appended to so every boot of the run is in it.
+		f, err := os.OpenFile(path.Join(outDir, consoleLog),
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fmt.Fprintf(f, "==== goru: booting %s at %s ====\n", arch, time.Now().Format(time.RFC3339))
+		if console != nil {
+			console = io.MultiWriter(console, f)
+		} else {
+			console = f
+		}
+	}
+
+	qemucmd, qemuDone, err := expect.SpawnWithArgs(
+		qemuArgs,
+		1*time.Hour,
+		expect.Tee(nwc{c.out(), console}),
+		// Output arriving with a match, like the boot loader's
+		// prompt right after the installer is done, is left for
+		// the next step rather than dropped.
+		expect.PartialMatch(true),
+	)
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return fmt.Errorf("%s not found on PATH — install qemu for arch %s",
+				qemuArgs[0], arch)
+		}
+		return err
+	}
+	defer qemucmd.Close()
+
+	batchDone := make(chan error, 1)
+	go func() {
+		for _, p := range phases {
+			if err := c.runPhase(ctx, qemucmd, arch, p); err != nil {
+				batchDone <- err
+				return
+			}
+		}
+		batchDone <- nil
+	}()
+
+	select {
+	case err = <-batchDone:
+		if err != nil {
+			return err
+		}
+		if collect != nil {
+			if err := collect(ctx); err != nil {
+				return err
+			}
+		}
+		if _, err := qemucmd.ExpectBatch(halt, haltWait); err != nil {
+			return fmt.Errorf("%s guest failed powering off: %w", arch, err)
+		}
+		select {
+		case <-qemuDone:
+		case <-time.After(haltWait):
+			return fmt.Errorf("%s guest didn't power off within %s", arch, haltWait)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if collect == nil {
+			return nil
+		}
+		return reportDiff(outDir, arch)
+	case qErr := <-qemuDone:
+		// The deferred Close tears down the batch still waiting on
+		// output that will never come.
+		code := 0
+		var exitErr *exec.ExitError
+		if errors.As(qErr, &exitErr) {
+			code = exitErr.ExitCode()
+		} else if qErr != nil {
+			return fmt.Errorf("%s exited before the build finished: %s",
+				qemuArgs[0], qErr)
+		}
+		return fmt.Errorf("%s exited before the build finished with status %d",
+			qemuArgs[0], code)
+	case <-ctx.Done():
+		// The deferred Close kills qemu and stops the server.
+		return ctx.Err()
+	}
+}
+
+// runPhase runs p's batch against the guest's console.
+func (c *Config) runPhase(ctx context.Context, qemucmd *expect.GExpect, arch string, p phase) error {
+	limit := p.timeout
+	if limit <= 0 {
+		limit = stepWait
+	}
+	if d, ok := ctx.Deadline(); ok && time.Until(d) < limit {
+		limit = time.Until(d)
+	}
+	if c.Verbose {
+		slog.Info("phase", "arch", arch, "phase", p.name)
+	}
+	res, err := qemucmd.ExpectBatch(p.batch, limit)
+	if err != nil && len(res) > 0 {
+		i := res[len(res)-1].Idx
+		err = fmt.Errorf("%s guest failed in the %s phase waiting for %s (step %d of %d): %w",
+			arch, p.name, waitingFor(p.batch[i]), i+1, len(p.batch), err)
+	}
+	var timeout expect.TimeoutError
+	if errors.As(err, &timeout) && len(res) > 0 && res[len(res)-1].Idx < p.bootSteps {
+		err = fmt.Errorf("%w: %s", ErrBootHang, err)
+	}
+	return err
+}
+
+// listen opens the server's socket, on a free port when Port is 0.
+// Everything handed to the guest after this uses the port it got.
+func (c *Config) listen() (net.Listener, error) {
+	// qemu's user networking reaches the host's loopback through
+	// the gateway, so nothing else needs to see the server.
+	bind := c.BindAddr
+	if bind == "" {
+		bind = "127.0.0.1"
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(bind, strconv.Itoa(c.Port)))
+	if err != nil {
+		return nil, fmt.Errorf("can't serve the guest: %w", err)
+	}
+	c.port = l.Addr().(*net.TCPAddr).Port
+	return l, nil
+}
+
+// serve runs the http server the guest talks to on l, returning a
+// function stopping it.
+func (c *Config) serve(l net.Listener, h http.Handler) func() {
+	ser := &http.Server{Handler: c.requireToken(h)}
+
+	go ser.Serve(l)
+	return func() {
+		// Give a request still in flight, like the diff upload, a
+		// moment to finish.
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+		defer cancel()
+		if err := ser.Shutdown(sctx); err != nil {
+			ser.Close()
+		}
+		c.port = 0
+	}
+}
+
+// removeStale makes sure a diff left over from a previous run isn't
+// reported.
+func removeStale(outDir, arch string) error {
+	for _, f := range []string{DiffName(arch), DiffName(arch) + ".b64"} {
+		err := os.Remove(path.Join(outDir, f))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// consoleFailure is output on the guest's console that means the step
+// being waited for will never come.
+type consoleFailure struct {
+	re, msg string
+}
+
+// installFailures are the installer's ways of giving up.
+var installFailures = []consoleFailure{
+	{`failed; check /tmp/ai/ai\.log`, "autoinstall failed"},
+	{`No disks found`, "installer found no disk to install to"},
+	{`Connection refused`, "installer couldn't reach the server"},
+	{`Error retrieving file`, "installer couldn't fetch a set"},
+}
+
+// loginFailures are the console's ways of refusing a login.
+var loginFailures = []consoleFailure{
+	{`Login incorrect`, "guest refused the root password"},
+}
+
+// failOn turns failures into cases aborting a batch with their
+// message.
+func failOn(failures []consoleFailure) []expect.Caser {
+	var cases []expect.Caser
+	for _, f := range failures {
+		cases = append(cases, &expect.Case{
+			R: regexp.MustCompile(f.re),
+			T: expect.Fail(expect.NewStatus(codes.Aborted, f.msg)),
+		})
+	}
+	return cases
+}
+
+// waitingFor describes what an expect step of a batch waits for.
+func waitingFor(b expect.Batcher) string {
+	if b.Cmd() != expect.BatchSwitchCase {
+		return fmt.Sprintf("%q", b.Arg())
+	}
+	var res []string
+	for _, c := range b.Cases() {
+		if re, err := c.RE(); err == nil {
+			res = append(res, fmt.Sprintf("%q", re))
+		}
+	}
+	return strings.Join(res, " or ")
+}
+
+// Distro is an OS whose install media goru fetches, verifies and
+// boots to run the build in, for a single arch.
+type Distro interface {
+	Arch() string
+	Fetch(ctx context.Context, dest, ver, smushVer string) error
+	Verify(ctx context.Context, dest, ver, smushVer string) error
+	// Build installs and runs the recipe in one boot of the guest
+	// where it can, Install and Run in a boot each.
+	Build(ctx context.Context, dest, ver, smushVer string) error
+	Install(ctx context.Context, dest, ver, smushVer string) error
+	Run(ctx context.Context, dest, ver, smushVer string) error
+	// Tools lists the host binaries the stages being run need.
+	Tools() []string
+}
+
+// Sets are the arches a run builds.
+type Sets []Distro
+
+func (s Sets) Sort() {
+	sort.Slice(s, func(i, j int) bool {
+		return s[i].Arch() < s[j].Arch()
+	})
+}
+
+// Only returns the sets for the given arches.
+func (s Sets) Only(arches []string) (Sets, error) {
+	var valid []string
+	for a := range archMap {
+		valid = append(valid, a)
+	}
+	sort.Strings(valid)
+
+	var sel Sets
+	for _, a := range arches {
+		if _, ok := archMap[a]; !ok {
+			return nil, fmt.Errorf("unknown arch %q, valid arches are: %s",
+				a, strings.Join(valid, ", "))
+		}
+		found := false
+		for _, set := range s {
+			if set.Arch() == a {
+				sel = append(sel, set)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s isn't enabled for building", a)
+		}
+	}
+	return sel, nil
+}
+
+// CheckMirror makes sure m is an http URL with the three %s
+// placeholders Fetch fills in.
+func CheckMirror(m string) error {
+	if n := strings.Count(m, "%s"); n != 3 || strings.Count(m, "%") != 3 {
+		return errors.New("needs exactly three %s placeholders: release, arch and file")
+	}
+	u, err := url.Parse(fmt.Sprintf(m, "7.5", "amd64", "SHA256"))
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("needs to be an http or https URL")
+	}
+	return nil
+}
+
+func readAI(name string) (string, error) {
+	s, err := aiFS.ReadFile(path.Join("autoinstall", name))
+	if err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// QemuArch is how qemu runs an arch's guest.
+type QemuArch struct {
+	Binary  string
+	Machine string
+	CPU     string
+	CPUs    int
+	MemMB   int
+	NIC     string
+	// Iface is what the installer calls the NIC: em0 for e1000,
+	// vio0 for virtio.
+	Iface string
+	// Disk is what the installer calls the drive: wd0 for the IDE
+	// disk pc machines get, sd0 for the virtio disk on virt. DiskIf
+	// is qemu's if= for it, the machine's default when empty.
+	Disk   string
+	DiskIf string
+	// Virtio is set when the guest has drivers for a virtio NIC and
+	// disk on Machine, which -virtio switches to.
+	Virtio bool
+	// BIOS and Kernel list the usual places the firmware passed to
+	// -bios and -kernel is installed.
+	BIOS   []string
+	Kernel []string
+	// Unsupported says why qemu can't run the installer for the arch,
+	// which has its build skipped.
+	Unsupported string
+}
+
+// QemuArches are the built-in qemu setups for the OpenBSD arches.
+var QemuArches = map[string]QemuArch{
+	"amd64": {
+		Binary: "qemu-system-x86_64",
+		CPUs:   4,
+		MemMB:  2048,
+		NIC:    "e1000",
+		Iface:  "em0",
+		Disk:   "wd0",
+		Virtio: true,
+	},
+	"i386": {
+		Binary: "qemu-system-i386",
+		CPUs:   4,
+		MemMB:  2048,
+		NIC:    "e1000",
+		Iface:  "em0",
+		Disk:   "wd0",
+		Virtio: true,
+	},
+	"arm64": {
+		Binary:  "qemu-system-aarch64",
+		Machine: "virt",
+		CPU:     "cortex-a57",
+		CPUs:    4,
+		MemMB:   2048,
+		NIC:     "e1000",
+		Iface:   "em0",
+		Disk:    "sd0",
+		BIOS:    edk2Aarch64,
+		Virtio:  true,
+	},
+	"octeon": {
+		Binary: "qemu-system-mips64",
+		CPUs:   4,
+		MemMB:  2048,
+		NIC:    "e1000",
+		Iface:  "em0",
+		Disk:   "wd0",
+	},
+	"armv7": {
+		Binary: "qemu-system-arm",
+		CPUs:   1,
+		MemMB:  1024,
+		NIC:    "e1000",
+		Iface:  "em0",
+		Disk:   "wd0",
+	},
+	// OpenBSD/riscv64 runs on qemu's virt machine, OpenSBI loads
+	// U-Boot in S-mode which then starts the EFI bootloader giving
+	// us the usual boot> prompt. The virt machine has no e1000 so
+	// the nic is virtio (vio0).
+	"riscv64": {
+		Binary:  "qemu-system-riscv64",
+		Machine: "virt",
+		CPUs:    1,
+		MemMB:   2048,
+		NIC:     "virtio",
+		Iface:   "vio0",
+		Disk:    "sd0",
+		BIOS:    openSBI,
+		Kernel:  uBootRiscv64,
+		Virtio:  true,
+	},
+	// sun4u comes with OpenBIOS built in and a Happy Meal nic,
+	// hme0 to OpenBSD.
+	"sparc64": {
+		Binary:      "qemu-system-sparc64",
+		Machine:     "sun4u",
+		CPUs:        1,
+		MemMB:       1024,
+		NIC:         "sunhme",
+		Iface:       "hme0",
+		Disk:        "wd0",
+		Unsupported: "Go has no sparc64 port",
+	},
+	"powerpc64": {
+		Binary:      "qemu-system-ppc64",
+		Machine:     "powernv9",
+		CPUs:        1,
+		MemMB:       2048,
+		NIC:         "e1000",
+		Iface:       "em0",
+		Disk:        "sd0",
+		BIOS:        skiboot,
+		Unsupported: "qemu's powernv9 machine can't take the disk as a plain -drive",
+	},
+	"loongarch64": {
+		Binary:      "qemu-system-loongarch64",
+		Machine:     "virt",
+		CPUs:        1,
+		MemMB:       2048,
+		NIC:         "virtio",
+		Iface:       "vio0",
+		Disk:        "sd0",
+		Unsupported: "OpenBSD has no loongarch64 release to install",
+		Virtio:      true,
+	},
+}
+
+// edk2Aarch64 are the usual places qemu's arm64 UEFI firmware gets
+// installed.
+var edk2Aarch64 = []string{
+	"/usr/share/qemu/edk2-aarch64-code.fd",
+	"/usr/local/share/qemu/edk2-aarch64-code.fd",
+	"/opt/homebrew/share/qemu/edk2-aarch64-code.fd",
+	"/usr/share/edk2/aarch64/QEMU_EFI.fd",
+	"/usr/share/qemu-efi-aarch64/QEMU_EFI.fd",
+	"/usr/share/AAVMF/AAVMF_CODE.fd",
+}
+
+// openSBI and uBootRiscv64 are where the riscv64 firmware is usually
+// installed. U-Boot has to be the S-mode build.
+var openSBI = []string{
+	"/usr/share/qemu/opensbi-riscv64-generic-fw_dynamic.bin",
+	"/usr/local/share/qemu/opensbi-riscv64-generic-fw_dynamic.bin",
+	"/opt/homebrew/share/qemu/opensbi-riscv64-generic-fw_dynamic.bin",
+	"/usr/local/share/opensbi/lp64/generic/firmware/fw_jump.bin",
+	"/usr/lib/riscv64-linux-gnu/opensbi/generic/fw_jump.bin",
+}
+
+var uBootRiscv64 = []string{
+	"/usr/lib/u-boot/qemu-riscv64_smode/u-boot.bin",
+	"/usr/local/share/u-boot/qemu-riscv64_smode/u-boot.bin",
+	"/usr/share/u-boot/qemu-riscv64_smode/u-boot.bin",
+}
+
+// skiboot is the OPAL firmware qemu's powernv machines boot.
+var skiboot = []string{
+	"/usr/share/qemu/skiboot.lid",
+	"/usr/local/share/qemu/skiboot.lid",
+	"/opt/homebrew/share/qemu/skiboot.lid",
+}
+
+// firmware returns file if set, otherwise the first of candidates that
+// exists. Failing that the first candidate is returned so the error
+// when it's checked points somewhere sensible.
+func firmware(file *string, candidates []string) string {
+	if file != nil && *file != "" {
+		return *file
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	for _, c := range candidates {
+		if _, err := os.Stat(c); err == nil {
+			return c
+		}
+	}
+	return candidates[0]
+}
+
+// NewOpenBSD sets up arch to run with q, applying the per-arch flags.
+// It fails for arches with no autoinstall template.
+func NewOpenBSD(cfg *Config, arch, pkgArch string, q QemuArch, sets setList) (*OpenBSD, error) {
+	instScpt, err := readAI(arch + "-autoinstall.conf")
+	if err != nil {
+		return nil, fmt.Errorf("%s: no autoinstall template: %w", arch, err)
+	}
+	o := &OpenBSD{
+		arch:     arch,
+		pkgArch:  pkgArch,
+		sets:     sets,
+		cfg:      cfg,
+		instScpt: instScpt,
+		qemu:     q,
+		bios:     firmware(cfg.BIOS[arch], q.BIOS),
+		kernel:   firmware(cfg.Kernel[arch], q.Kernel),
+		disk:     q.Disk,
+	}
+	if cfg.Virtio && q.Virtio {
+		o.qemu.NIC, o.qemu.Iface = "virtio", "vio0"
+		o.qemu.DiskIf, o.disk = "virtio", "sd0"
+	}
+	if d := cfg.Disk[arch]; d != nil && *d != "" {
+		o.disk = *d
+	}
+	if m := cfg.Mem[arch]; m != nil {
+		o.qemu.MemMB = *m
+	}
+	if c := cfg.CPUs[arch]; c != nil {
+		o.qemu.CPUs = *c
+	}
+	return o, nil
+}
+
+// DefaultSets is the built-in arch matrix.
+func DefaultSets(cfg *Config, smushVer string) (Sets, error) {
+	var sets Sets
+	for _, a := range []struct{ arch, pkgArch string }{
+		{"arm64", "aarch64"},
+		{"amd64", "amd64"},
+		{"i386", "i386"},
+		//{"octeon", "mips64"},
+		//{"armv7", "arm"},
+		{"riscv64", "riscv64"},
+		//{"sparc64", "sparc64"},
+		//{"powerpc64", "powerpc64"},
+		//{"loongarch64", "loongarch64"},
+	} {
+		o, err := NewOpenBSD(cfg, a.arch, a.pkgArch, QemuArches[a.arch], newSetList(smushVer))
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, o)
+	}
+	return sets, nil
+}
+
+// RequiredTools lists the host binaries every arch needs, once each.
+func (s Sets) RequiredTools() []string {
+	seen := map[string]bool{}
+	var tools []string
+	for _, set := range s {
+		for _, t := range set.Tools() {
+			if !seen[t] {
+				seen[t] = true
+				tools = append(tools, t)
+			}
+		}
+	}
+	return tools
+}
+
+// MissingTools returns the tools that aren't on PATH.
+func MissingTools(tools []string) []string {
+	var missing []string
+	for _, t := range tools {
+		if _, err := exec.LookPath(t); err != nil {
+			missing = append(missing, t)
+		}
+	}
+	return missing
+}
+
+// RunArch runs the stages in cfg.Stages for set, recording how far it
+// got.
+func RunArch(ctx context.Context, cfg *Config, set Distro, dest, release, smushVer string) Result {
+	start := time.Now()
+	res := Result{Arch: set.Arch()}
+	err := runStages(ctx, cfg, set, &res, dest, release, smushVer)
+	if err != nil {
+		res.Error = err.Error()
+	} else if diff, err := os.ReadFile(path.Join(dest, set.Arch(), DiffName(set.Arch()))); err == nil {
+		st := ParseDiffStat(diff)
+		res.DiffSize, res.Diff = int64(len(diff)), &st
+	}
+	res.Seconds = time.Since(start).Seconds()
+	return res
+}
+
+// runStages fetches, verifies and builds an arch, or whichever of
+// those the subcommand asked for, keeping track of the stage reached
+// in res. The build is either one boot or Install and Run, each
+// retried on its own when the guest hangs booting.
+func runStages(ctx context.Context, cfg *Config, set Distro, res *Result, dest, release, smushVer string) error {
+	run := cfg.Stages
+	if run["fetch"] {
+		res.Stage = "fetch"
+		slog.Info("fetching sets", "arch", set.Arch(), "stage", res.Stage)
+		err := set.Fetch(ctx, dest, release, smushVer)
+		if err != nil {
+			return err
+		}
+	}
+
+	if run["verify"] {
+		res.Stage = "verify"
+		slog.Info("verifying sets", "arch", set.Arch(), "stage", res.Stage)
+		err := set.Verify(ctx, dest, release, smushVer)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The console log of an earlier run is cleared once here, not
+	// per boot, so the boots retried below are kept.
+	if cfg.ConsoleLog && !cfg.DryRun && (run["install"] || run["run"] || run["build"]) {
+		err := os.Remove(path.Join(dest, set.Arch(), consoleLog))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for _, stage := range []struct {
+		name, msg string
+		boot      func(context.Context, string, string, string) error
+	}{
+		{"install", "installing", set.Install},
+		{"run", "running the recipe", set.Run},
+		{"build", "building", set.Build},
+	} {
+		if !run[stage.name] {
+			continue
+		}
+		res.Stage = stage.name
+		slog.Info(stage.msg, "arch", set.Arch(), "stage", res.Stage)
+		var err error
+		for try := 0; ; try++ {
+			err = stage.boot(ctx, dest, release, smushVer)
+			if !errors.Is(err, ErrBootHang) || try >= cfg.BootRetries {
+				break
+			}
+			// BootRetries counts the boots after the first.
+			slog.Warn("guest hung booting, retrying", "arch", set.Arch(), "stage", res.Stage, "err", err,
+				"attempt", try+2, "max_attempts", cfg.BootRetries+1)
+		}
+		if errors.Is(err, ErrUnsupported) {
+			res.Stage = "skipped"
+			slog.Warn("skipping build", "arch", set.Arch(), "err", err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.ApplyTo != "" && !cfg.DryRun && (run["build"] || run["run"]) {
+		res.Stage = "apply"
+		slog.Info("applying the diff", "arch", set.Arch(), "stage", res.Stage, "checkout", cfg.ApplyTo)
+		if err := cfg.applyDiff(ctx, path.Join(dest, set.Arch()), set.Arch()); err != nil {
+			return err
+		}
+	}
+
+	res.Stage = "done"
+	return nil
+}
@@ -0,0 +1,659 @@
+package goru
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	expect "github.com/google/goexpect"
+)
+
+// recordingRunner records the commands it's asked to run instead of
+// running them.
+type recordingRunner struct {
+	mu    sync.Mutex
+	calls []call
+}
+
+type call struct {
+	dir  string
+	args []string
+}
+
+func (r *recordingRunner) Run(ctx context.Context, dir, name string, args ...string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call{dir, append([]string{name}, args...)})
+	return nil, nil
+}
+
+// testOpenBSD is arch of release smushVer with the built-in qemu
+// setup.
+func testOpenBSD(t *testing.T, cfg *Config, arch, smushVer string) *OpenBSD {
+	t.Helper()
+	o, err := NewOpenBSD(cfg, arch, arch, QemuArches[arch], newSetList(smushVer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestCreateDiskCommands(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		want   []call
+	}{
+		{"raw", []call{
+			{"", []string{"qemu-img", "create", "-f", "raw", "-o", "preallocation=full", "disk.raw", "64M"}},
+			{"", []string{"dd", "conv=notrunc", "if=miniroot75.img", "of=disk.raw"}},
+		}},
+		{"qcow2", []call{
+			{"", []string{"qemu-img", "convert", "-f", "raw", "-O", "qcow2", "miniroot75.img", "disk.qcow2"}},
+			{"", []string{"qemu-img", "resize", "-f", "qcow2", "disk.qcow2", "64M"}},
+		}},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			r := &recordingRunner{}
+			cfg := &Config{Runner: r, DiskSize: 64, DiskFormat: tc.format}
+			o := testOpenBSD(t, cfg, "amd64", "75")
+
+			outDir := t.TempDir()
+			if err := os.WriteFile(path.Join(outDir, "miniroot75.img"), nil, 0640); err != nil {
+				t.Fatal(err)
+			}
+			if err := o.createDisk(context.Background(), outDir, "75"); err != nil {
+				t.Fatal(err)
+			}
+			for i := range tc.want {
+				tc.want[i].dir = outDir
+			}
+			if !reflect.DeepEqual(r.calls, tc.want) {
+				t.Errorf("ran %q, want %q", r.calls, tc.want)
+			}
+		})
+	}
+}
+
+func TestCreateOverlayCommand(t *testing.T) {
+	r := &recordingRunner{}
+	cfg := &Config{Runner: r, DiskFormat: "raw"}
+	outDir := t.TempDir()
+	if err := cfg.createOverlay(context.Background(), outDir); err != nil {
+		t.Fatal(err)
+	}
+	want := []call{{outDir, []string{"qemu-img", "create", "-f", "qcow2",
+		"-b", "base.raw", "-F", "raw", "overlay.qcow2"}}}
+	if !reflect.DeepEqual(r.calls, want) {
+		t.Errorf("ran %q, want %q", r.calls, want)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"qemu-system-x86_64", "-m", "2048"}, "qemu-system-x86_64 -m 2048"},
+		{[]string{"-drive", "file=/tmp/openbsd/7.5/amd64/disk.raw,format=raw"},
+			"-drive file=/tmp/openbsd/7.5/amd64/disk.raw,format=raw"},
+		{[]string{""}, "''"},
+		{[]string{"a b"}, "'a b'"},
+		{[]string{"it's"}, `'it'\''s'`},
+		{[]string{"$HOME", "*"}, "'$HOME' '*'"},
+	} {
+		if got := shellQuote(tc.args); got != tc.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestShellQuoteRoundTrip(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+	args := []string{"plain", "", "two words", "it's", `back\slash`, "$(false)", "new\nline"}
+	// The shell splits the quoted line back into the args.
+	out, err := exec.Command(sh, "-c", `eval "set -- $1"; for a; do printf '%s\0' "$a"; done`,
+		"sh", shellQuote(args)).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	if !reflect.DeepEqual(got, args) {
+		t.Errorf("the shell read %q back, want %q", got, args)
+	}
+}
+
+func TestGuestURLsShareThePort(t *testing.T) {
+	cfg := &Config{HostAddr: "10.0.2.2", GuestVerify: true}
+	// What listen records when -port 0 got a free port.
+	cfg.port = 31234
+	hostPort := regexp.MustCompile(regexp.QuoteMeta(cfg.HostAddr) + `:(\d+)`)
+
+	entries, err := aiFS.ReadDir("autoinstall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		arch := strings.TrimSuffix(e.Name(), "-autoinstall.conf")
+		o := testOpenBSD(t, cfg, arch, "75")
+		text, err := o.responseFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		phases, _, err := o.batch(false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range phases {
+			for _, b := range p.batch {
+				if b.Cmd() == expect.BatchSend {
+					text += b.Arg()
+				}
+			}
+		}
+
+		// The disklabel URL and set server in install.conf, the
+		// install.conf URL and the diff upload in the batch.
+		found := hostPort.FindAllStringSubmatch(text, -1)
+		if len(found) < 4 {
+			t.Errorf("%s: found %d guest URLs, want at least 4 in:\n%s", arch, len(found), text)
+		}
+		for _, m := range found {
+			if m[1] != "31234" {
+				t.Errorf("%s: %s uses port %s, want 31234", arch, m[0], m[1])
+			}
+		}
+	}
+}
+
+func TestResponseFile(t *testing.T) {
+	cfg := &Config{
+		HostAddr: "10.0.2.2",
+		Port:     25706,
+		Guest: GuestSetup{
+			Hostname: "builder",
+			User:     "alice",
+			FullName: "Alice Example",
+			UserPass: "secret",
+			RootPass: "toor",
+			Sets:     "-all bsd* base* done",
+		},
+		SSHD:     true,
+		RootSSH:  "prohibit-password",
+		Timezone: "Europe/Berlin",
+		Token:    "t0k3n",
+	}
+
+	for _, tc := range []struct {
+		arch       string
+		iface      string
+		disk       string
+		verify     bool
+		unverified string // the answer to continuing without SHA256.sig
+	}{
+		{"amd64", "em0", "wd0", false, "yes"},
+		{"riscv64", "vio0", "sd0", true, "no"},
+	} {
+		t.Run(tc.arch, func(t *testing.T) {
+			cfg := *cfg
+			cfg.GuestVerify = tc.verify
+			o := testOpenBSD(t, &cfg, tc.arch, "75")
+			conf, err := o.responseFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := map[string]bool{}
+			for _, l := range strings.Split(conf, "\n") {
+				lines[l] = true
+			}
+			for _, want := range []string{
+				"System hostname = builder",
+				"Which network interface = " + tc.iface,
+				"Password for root account = toor",
+				"Setup a user = alice",
+				"Full name for user alice = Alice Example",
+				"Password for user alice = secret",
+				"Start sshd(8) by default = yes",
+				"Allow root ssh login = prohibit-password",
+				"What timezone = Europe/Berlin",
+				"Which disk = " + tc.disk,
+				"URL to autopartitioning template for disklabel = http://10.0.2.2:25706/t0k3n/disklabel",
+				"http server? = 10.0.2.2:25706",
+				"server directory? = /t0k3n/pub",
+				"Set name(s) = -all bsd* base* done",
+				"Continue without verification = " + tc.unverified,
+			} {
+				if !lines[want] {
+					t.Errorf("missing %q in:\n%s", want, conf)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerSignatures(t *testing.T) {
+	outDir := t.TempDir()
+	writeSets(t, outDir, map[string]string{"bsd.rd": "ramdisk kernel"})
+	for _, tc := range []struct {
+		verify bool
+		code   int
+	}{
+		{false, http.StatusNotFound},
+		{true, http.StatusOK},
+	} {
+		cfg := &Config{GuestVerify: tc.verify}
+		h := testOpenBSD(t, cfg, "amd64", "75").handler(outDir, "", nil)
+		for _, file := range []string{"SHA256", "SHA256.sig"} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/pub/"+file, nil))
+			if w.Code != tc.code {
+				t.Errorf("GuestVerify %v: got %d for %s, want %d", tc.verify, w.Code, file, tc.code)
+			}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/pub/bsd.rd", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("GuestVerify %v: got %d for bsd.rd", tc.verify, w.Code)
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	cfg := &Config{Token: "t0k3n"}
+	var got string
+	h := cfg.requireToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Path
+	}))
+	for _, tc := range []struct {
+		path string
+		code int
+		want string // the path h sees
+	}{
+		{"/t0k3n/install.conf", http.StatusOK, "/install.conf"},
+		{"/t0k3n/pub/7.5/amd64/bsd.rd", http.StatusOK, "/pub/7.5/amd64/bsd.rd"},
+		{"/t0k3n", http.StatusOK, "/"},
+		{"/install.conf", http.StatusForbidden, ""},
+		{"/t0k3nX/install.conf", http.StatusForbidden, ""},
+		{"/pub/t0k3n/install.conf", http.StatusForbidden, ""},
+	} {
+		got = ""
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != tc.code || got != tc.want {
+			t.Errorf("%s: got %d for %q, want %d for %q", tc.path, w.Code, got, tc.code, tc.want)
+		}
+	}
+}
+
+func TestDriveMatchesArch(t *testing.T) {
+	cfg := &Config{DiskFormat: "raw"}
+	dest := "/tmp/dest"
+	sets, err := DefaultSets(cfg, "75")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range sets {
+		o := d.(*OpenBSD)
+		// The disk path the way Build makes it.
+		disk := path.Join(dest, o.arch, cfg.diskFile())
+		args := o.qemuArgs(disk, cfg.DiskFormat)
+		var drive string
+		for i, a := range args {
+			if a == "-drive" && i+1 < len(args) {
+				drive = args[i+1]
+			}
+		}
+		if want := "file=" + path.Join(dest, o.arch) + "/"; !strings.HasPrefix(drive, want) {
+			t.Errorf("%s: -drive %q isn't in %s", o.arch, drive, want)
+		}
+	}
+}
+
+func TestQemuArgs(t *testing.T) {
+	bios, kernel := "/fw/bios.bin", "/fw/u-boot.bin"
+	drive := []string{"-drive", "file=disk.raw,format=raw"}
+	for _, tc := range []struct {
+		arch string
+		want []string
+	}{
+		{"amd64", []string{"qemu-system-x86_64", "-nographic",
+			"-m", "2048", "-smp", "4",
+			"-net", "nic,model=e1000", "-net", "user"}},
+		{"i386", []string{"qemu-system-i386", "-nographic",
+			"-m", "2048", "-smp", "4",
+			"-net", "nic,model=e1000", "-net", "user"}},
+		{"arm64", []string{"qemu-system-aarch64", "-nographic",
+			"-machine", "virt", "-cpu", "cortex-a57", "-m", "2048", "-smp", "4",
+			"-net", "nic,model=e1000", "-net", "user",
+			"-bios", bios}},
+		{"riscv64", []string{"qemu-system-riscv64", "-nographic",
+			"-machine", "virt", "-m", "2048",
+			"-net", "nic,model=virtio", "-net", "user",
+			"-bios", bios, "-kernel", kernel}},
+		{"sparc64", []string{"qemu-system-sparc64", "-nographic",
+			"-machine", "sun4u", "-m", "1024",
+			"-net", "nic,model=sunhme", "-net", "user"}},
+	} {
+		t.Run(tc.arch, func(t *testing.T) {
+			// Firmware from the config and no accelerator, so it
+			// doesn't matter what's installed on the host.
+			cfg := &Config{DiskFormat: "raw", NoAccel: true}
+			if q := QemuArches[tc.arch]; len(q.BIOS) > 0 {
+				cfg.BIOS = map[string]*string{tc.arch: &bios}
+			}
+			if q := QemuArches[tc.arch]; len(q.Kernel) > 0 {
+				cfg.Kernel = map[string]*string{tc.arch: &kernel}
+			}
+			o := testOpenBSD(t, cfg, tc.arch, "75")
+			want := append(tc.want, drive...)
+			if got := o.qemuArgs("disk.raw", "raw"); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q\nwant %q", got, want)
+			}
+		})
+	}
+}
+
+// writeSets writes files to dir along with a SHA256 listing them and
+// a SHA256.sig, returning their sums.
+func writeSets(t *testing.T, dir string, files map[string]string) map[string]string {
+	t.Helper()
+	sums := map[string]string{}
+	var list string
+	for file, body := range files {
+		if err := os.WriteFile(path.Join(dir, file), []byte(body), 0640); err != nil {
+			t.Fatal(err)
+		}
+		h := sha256.Sum256([]byte(body))
+		sums[file] = hex.EncodeToString(h[:])
+		list += fmt.Sprintf("SHA256 (%s) = %s\n", file, sums[file])
+	}
+	for file, body := range map[string]string{"SHA256": list, "SHA256.sig": "sig\n"} {
+		if err := os.WriteFile(path.Join(dir, file), []byte(body), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sums
+}
+
+// fakeSignify puts an executable named like signify on PATH, for the
+// lookup Verify makes before handing the checks to the runner.
+func fakeSignify(t *testing.T) {
+	t.Helper()
+	bin := t.TempDir()
+	if err := os.WriteFile(path.Join(bin, signifyBin()), []byte("#!/bin/sh\n"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+}
+
+func TestVerifySignifyCommand(t *testing.T) {
+	fakeSignify(t)
+	r := &recordingRunner{}
+	cfg := &Config{Runner: r, CacheDir: t.TempDir()}
+	// A release with no key in /etc/signify, so the cached one is
+	// used.
+	key := path.Join(cfg.CacheDir, "openbsd-99-base.pub")
+	if err := os.WriteFile(key, []byte("key\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	o := testOpenBSD(t, cfg, "amd64", "99")
+
+	dest := t.TempDir()
+	outDir := path.Join(dest, "amd64")
+	if err := os.Mkdir(outDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	writeSets(t, outDir, map[string]string{"bsd": "kernel"})
+
+	if err := o.Verify(context.Background(), dest, "9.9", "99"); err != nil {
+		t.Fatal(err)
+	}
+	want := []call{{outDir, []string{signifyBin(), "-C", "-p", key, "-x", "SHA256.sig", "bsd"}}}
+	if !reflect.DeepEqual(r.calls, want) {
+		t.Errorf("ran %q, want %q", r.calls, want)
+	}
+}
+
+func TestVerifySomeSets(t *testing.T) {
+	// No signify, so only SHA256 is checked.
+	t.Setenv("PATH", t.TempDir())
+	cfg := &Config{SHA256Only: true}
+	o := testOpenBSD(t, cfg, "amd64", "99")
+	dest := t.TempDir()
+	outDir := path.Join(dest, "amd64")
+	if err := os.Mkdir(outDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	// Only some of the sets, and none in the working directory, so
+	// they're only found where Fetch puts them.
+	writeSets(t, outDir, map[string]string{
+		"bsd.rd":     "ramdisk kernel",
+		"base99.tgz": "base set",
+	})
+	if err := o.Verify(context.Background(), dest, "9.9", "99"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without signify, only checking SHA256 has to be asked for.
+	cfg.SHA256Only = false
+	if err := o.Verify(context.Background(), dest, "9.9", "99"); err == nil {
+		t.Error("verified without signify")
+	}
+	cfg.SHA256Only = true
+
+	// The sets present are still checked.
+	if err := os.WriteFile(path.Join(outDir, "base99.tgz"), []byte("corrupt"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Verify(context.Background(), dest, "9.9", "99"); err == nil {
+		t.Error("verified a corrupt base99.tgz")
+	}
+}
+
+func TestCheckMirror(t *testing.T) {
+	for _, m := range []string{
+		DefaultMirror,
+		"http://mirror.example.org/OpenBSD/%s/%s/%s",
+		"https://example.org/%s-%s/%s",
+	} {
+		if err := CheckMirror(m); err != nil {
+			t.Errorf("CheckMirror(%q): %v", m, err)
+		}
+	}
+	for _, m := range []string{
+		"https://cdn.openbsd.org/pub/OpenBSD/%s/%s",
+		"https://cdn.openbsd.org/pub/OpenBSD/%s/%s/%s/%s",
+		"https://cdn.openbsd.org/pub/OpenBSD/%s/%d/%s",
+		"https://cdn.openbsd.org/pub/%20OpenBSD/%s/%s/%s",
+		"ftp://ftp.openbsd.org/pub/OpenBSD/%s/%s/%s",
+		"/pub/OpenBSD/%s/%s/%s",
+	} {
+		if err := CheckMirror(m); err == nil {
+			t.Errorf("CheckMirror(%q) succeeded", m)
+		}
+	}
+}
+
+func TestDefaultPrompts(t *testing.T) {
+	for _, tc := range []struct {
+		hostname   string
+		want       Prompts
+		root, user string // what the guest's shells print
+		notRoot    string
+	}{
+		{"buildlet", Prompts{"boot>", "login:", "Password:", "buildlet#", `buildlet\$`},
+			"buildlet# ", "buildlet$ ", "buildlet$ "},
+		{"build.er+1", Prompts{"boot>", "login:", "Password:", `build\.er\+1#`, `build\.er\+1\$`},
+			"build.er+1# ", "build.er+1$ ", "buildXer1# "},
+	} {
+		t.Run(tc.hostname, func(t *testing.T) {
+			got := DefaultPrompts(tc.hostname)
+			if got != tc.want {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+			if !regexp.MustCompile(got.Root).MatchString(tc.root) {
+				t.Errorf("root prompt %q doesn't match %q", got.Root, tc.root)
+			}
+			if !regexp.MustCompile(got.User).MatchString(tc.user) {
+				t.Errorf("user prompt %q doesn't match %q", got.User, tc.user)
+			}
+			if regexp.MustCompile(got.Root).MatchString(tc.notRoot) {
+				t.Errorf("root prompt %q matches %q", got.Root, tc.notRoot)
+			}
+		})
+	}
+}
+
+func TestPromptsOverride(t *testing.T) {
+	cfg := &Config{Guest: GuestSetup{Hostname: "builder"}}
+	cfg.Prompts.Login = "Login:"
+	want := Prompts{"boot>", "Login:", "Password:", "builder#", `builder\$`}
+	if got := cfg.prompts(); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestNewOpenBSDNoTemplate(t *testing.T) {
+	if _, err := NewOpenBSD(&Config{}, "vax", "vax", QemuArches["amd64"], newSetList("75")); err == nil {
+		t.Error("set up an arch with no autoinstall template")
+	}
+}
+
+func TestStreamDiffPipe(t *testing.T) {
+	pipe := path.Join(t.TempDir(), "diffs")
+	if err := syscall.Mkfifo(pipe, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{DiffPipe: pipe}
+
+	// Nothing is reading, which mustn't hold up the upload.
+	done := make(chan error, 1)
+	go func() { done <- cfg.streamDiff([]byte("diff\n")) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("streamed a diff with nothing reading the pipe")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("streaming blocked without a reader")
+	}
+
+	r, err := os.OpenFile(pipe, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := cfg.streamDiff([]byte("diff\n")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 16)
+	n, err := r.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b[:n]); got != "diff\n" {
+		t.Errorf("read %q, want %q", got, "diff\n")
+	}
+}
+
+// hangingDistro's Build hangs booting until its last try, writing a
+// line to the console log each time the way runGuest does.
+type hangingDistro struct {
+	tries, hangs int
+}
+
+func (h *hangingDistro) Arch() string { return "amd64" }
+
+func (h *hangingDistro) Fetch(ctx context.Context, dest, ver, smushVer string) error  { return nil }
+func (h *hangingDistro) Verify(ctx context.Context, dest, ver, smushVer string) error { return nil }
+func (h *hangingDistro) Install(ctx context.Context, dest, ver, smushVer string) error {
+	return nil
+}
+func (h *hangingDistro) Run(ctx context.Context, dest, ver, smushVer string) error { return nil }
+func (h *hangingDistro) Tools() []string                                           { return nil }
+
+func (h *hangingDistro) Build(ctx context.Context, dest, ver, smushVer string) error {
+	h.tries++
+	if err := os.MkdirAll(path.Join(dest, "amd64"), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path.Join(dest, "amd64", consoleLog), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "boot %d\n", h.tries)
+	if h.tries <= h.hangs {
+		return ErrBootHang
+	}
+	return nil
+}
+
+func TestConsoleLogKeepsRetries(t *testing.T) {
+	dest := t.TempDir()
+	outDir := path.Join(dest, "amd64")
+	if err := os.Mkdir(outDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(outDir, consoleLog), []byte("last run\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{ConsoleLog: true, BootRetries: 2, Stages: map[string]bool{"build": true}}
+
+	res := RunArch(context.Background(), cfg, &hangingDistro{hangs: 2}, dest, "7.5", "75")
+	if !res.OK() {
+		t.Fatalf("build failed: %s", res.Error)
+	}
+	got, err := os.ReadFile(path.Join(outDir, consoleLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "boot 1\nboot 2\nboot 3\n"; string(got) != want {
+		t.Errorf("console log is %q, want %q", got, want)
+	}
+}
+
+func TestBootRetryLog(t *testing.T) {
+	var buf strings.Builder
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	cfg := &Config{BootRetries: 2, Stages: map[string]bool{"build": true}}
+	res := RunArch(context.Background(), cfg, &hangingDistro{hangs: 2}, t.TempDir(), "7.5", "75")
+	if !res.OK() {
+		t.Fatalf("build failed: %s", res.Error)
+	}
+	for _, want := range []string{"attempt=2 max_attempts=3", "attempt=3 max_attempts=3"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log has no %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestDryRunOutput(t *testing.T) {
+	var out strings.Builder
+	cfg := &Config{DryRun: true, Output: &out, Mirrors: []string{"https://cdn.example/%s/%s/%s"}}
+	o := testOpenBSD(t, cfg, "amd64", "75")
+	if err := o.Fetch(context.Background(), t.TempDir(), "7.5", "75"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "\twould fetch https://cdn.example/7.5/amd64/SHA256.sig\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("Output has no %q:\n%s", want, out.String())
+	}
+}
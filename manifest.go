@@ -0,0 +1,131 @@
+package goru
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+)
+
+// ManifestFile is written to each arch's directory by Fetch and
+// updated by Verify.
+const ManifestFile = "manifest.json"
+
+// Manifest records the files fetched for an arch, where they came from
+// and whether they verified.
+type Manifest struct {
+	Release string          `json:"release"`
+	Arch    string          `json:"arch"`
+	Files   []ManifestEntry `json:"files"`
+}
+
+type ManifestEntry struct {
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Mirror is the host the file was last downloaded from.
+	Mirror string `json:"mirror,omitempty"`
+	// Verified is signify, sha256 or failed, or empty until Verify
+	// has checked the file. The sig files and index.txt aren't
+	// checked.
+	Verified string `json:"verified,omitempty"`
+}
+
+// ReadManifest reads the manifest in an arch's directory.
+func ReadManifest(dir string) (*Manifest, error) {
+	b, err := os.ReadFile(path.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// entry returns the file's entry, or nil if it isn't listed.
+func (m *Manifest) entry(file string) *ManifestEntry {
+	if m == nil {
+		return nil
+	}
+	for i := range m.Files {
+		if m.Files[i].File == file {
+			return &m.Files[i]
+		}
+	}
+	return nil
+}
+
+// write replaces the manifest in dir.
+func (m *Manifest) write(dir string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(dir, ManifestFile+".part")
+	if err := os.WriteFile(tmp, append(b, '\n'), 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, ManifestFile))
+}
+
+// hashFile returns the size and SHA-256 of fp.
+func hashFile(fp string) (int64, string, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeManifest lists the sets in outDir after a fetch. Files that
+// weren't downloaded this time keep the mirror they came from, and
+// their verification if they haven't changed.
+func (o *OpenBSD) writeManifest(outDir, ver string) error {
+	prev, _ := ReadManifest(outDir)
+	m := &Manifest{Release: ver, Arch: o.arch}
+	for _, file := range o.sets {
+		size, sum, err := hashFile(path.Join(outDir, file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		e := ManifestEntry{File: file, Size: size, SHA256: sum}
+		if p := prev.entry(file); p != nil {
+			e.Mirror = p.Mirror
+			if p.SHA256 == sum {
+				e.Verified = p.Verified
+			}
+		}
+		o.mu.Lock()
+		if host, ok := o.fetchedFrom[file]; ok {
+			e.Mirror = host
+		}
+		o.mu.Unlock()
+		m.Files = append(m.Files, e)
+	}
+	return m.write(outDir)
+}
+
+// fetched records the mirror file was downloaded from for the
+// manifest.
+func (o *OpenBSD) fetched(file, host string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.fetchedFrom == nil {
+		o.fetchedFrom = map[string]string{}
+	}
+	o.fetchedFrom[file] = host
+}
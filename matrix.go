@@ -0,0 +1,107 @@
+package goru
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// archConfig is an arch in a -config file. Fields left out keep the
+// built-in values for the arch.
+type archConfig struct {
+	Arch    string `json:"arch"`
+	PkgArch string `json:"pkgArch"`
+
+	Binary  string `json:"binary"`
+	Machine string `json:"machine"`
+	CPU     string `json:"cpu"`
+	CPUs    int    `json:"cpus"`
+	MemMB   int    `json:"memMB"`
+	NIC     string `json:"nic"`
+	Iface   string `json:"iface"`
+	Disk    string `json:"disk"`
+	DiskIf  string `json:"diskIf"`
+
+	// Sets replaces the set list, which is otherwise read from the
+	// release's index.txt. %s is replaced with the release, like 75.
+	Sets []string `json:"sets"`
+}
+
+// LoadSets reads the arch matrix from a JSON -config file.
+func LoadSets(cfg *Config, file, smushVer string) (Sets, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var arches []archConfig
+	if err := json.Unmarshal(b, &arches); err != nil {
+		return nil, fmt.Errorf("can't parse config %q: %w", file, err)
+	}
+	if len(arches) == 0 {
+		return nil, fmt.Errorf("config %q has no arches", file)
+	}
+
+	var sets Sets
+	seen := map[string]bool{}
+	for _, a := range arches {
+		// Each arch needs an autoinstall template and a GOARCH.
+		if _, ok := archMap[a.Arch]; !ok {
+			return nil, fmt.Errorf("config %q: unknown arch %q", file, a.Arch)
+		}
+		if seen[a.Arch] {
+			return nil, fmt.Errorf("config %q: %s is listed twice", file, a.Arch)
+		}
+		seen[a.Arch] = true
+
+		q := QemuArches[a.Arch]
+		override(&q.Binary, a.Binary)
+		override(&q.Machine, a.Machine)
+		override(&q.CPU, a.CPU)
+		override(&q.NIC, a.NIC)
+		override(&q.Iface, a.Iface)
+		override(&q.Disk, a.Disk)
+		override(&q.DiskIf, a.DiskIf)
+		if a.CPUs != 0 {
+			q.CPUs = a.CPUs
+		}
+		if a.MemMB != 0 {
+			q.MemMB = a.MemMB
+		}
+		if q.Binary == "" || q.NIC == "" || q.Iface == "" || q.Disk == "" || q.CPUs < 1 || q.MemMB < 1 {
+			return nil, fmt.Errorf("config %q: %s needs a qemu binary, nic, iface, disk, cpus and memMB",
+				file, a.Arch)
+		}
+
+		pkgArch := a.PkgArch
+		if pkgArch == "" {
+			pkgArch = a.Arch
+		}
+
+		sl := newSetList(smushVer)
+		if len(a.Sets) > 0 {
+			sl = nil
+			for _, s := range a.Sets {
+				if strings.Contains(s, "%s") {
+					s = fmt.Sprintf(s, smushVer)
+				}
+				sl = append(sl, s)
+			}
+		}
+
+		o, err := NewOpenBSD(cfg, a.Arch, pkgArch, q, sl)
+		if err != nil {
+			return nil, fmt.Errorf("config %q: %w", file, err)
+		}
+		o.fixedSets = len(a.Sets) > 0
+		sets = append(sets, o)
+	}
+
+	return sets, nil
+}
+
+func override(field *string, v string) {
+	if v != "" {
+		*field = v
+	}
+}
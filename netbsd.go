@@ -0,0 +1,441 @@
+package goru
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	expect "github.com/google/goexpect"
+)
+
+// NetBSDMirror is where NetBSD images are fetched from, with %s
+// placeholders for the release, port and file.
+var NetBSDMirror = "https://cdn.netbsd.org/pub/NetBSD/NetBSD-%s/%s/binary/gzimg/%s"
+
+// netbsdPrompt is the root prompt the batch sets, so it can't be
+// confused with anything else on the console.
+const netbsdPrompt = "goru# "
+
+// netbsdArch is how a NetBSD arch is run. Rather than driving sysinst,
+// the preinstalled image for the port is booted, which comes up on the
+// serial console with a passwordless root.
+type netbsdArch struct {
+	port    string // release directory, evbarm-aarch64
+	image   string // gzipped disk image in binary/gzimg
+	pkgArch string // pkgsrc's name for the arch
+	qemu    QemuArch
+}
+
+var netbsdArches = map[string]netbsdArch{
+	"arm64": {
+		port:    "evbarm-aarch64",
+		image:   "arm64.img.gz",
+		pkgArch: "aarch64",
+		qemu: QemuArch{
+			Binary:  "qemu-system-aarch64",
+			Machine: "virt",
+			CPU:     "cortex-a57",
+			CPUs:    4,
+			MemMB:   2048,
+			NIC:     "virtio",
+			Disk:    "ld0",
+			BIOS:    edk2Aarch64,
+		},
+	},
+}
+
+// NetBSD is a Distro building in a NetBSD guest.
+type NetBSD struct {
+	arch string
+	netbsdArch
+	bios string
+	cfg  *Config
+}
+
+// NetBSDSets is the NetBSD arch matrix.
+func NetBSDSets(cfg *Config) Sets {
+	var sets Sets
+	for arch, n := range netbsdArches {
+		sets = append(sets, &NetBSD{
+			arch:       arch,
+			netbsdArch: n,
+			bios:       firmware(cfg.BIOS[arch], n.qemu.BIOS),
+			cfg:        cfg,
+		})
+	}
+	return sets
+}
+
+func (n *NetBSD) Arch() string {
+	return n.arch
+}
+
+func (n *NetBSD) Tools() []string {
+	if !n.cfg.boots() {
+		return nil
+	}
+	return []string{"qemu-img", n.qemu.Binary}
+}
+
+func (n *NetBSD) url(ver, file string) string {
+	return fmt.Sprintf(NetBSDMirror, ver, n.port, file)
+}
+
+// Fetch downloads the image and its checksums. The checksums are
+// always fetched again, the image only if it's missing or with -force.
+func (n *NetBSD) Fetch(ctx context.Context, dest, ver, smushVer string) error {
+	outDir := path.Join(dest, n.arch)
+	for _, file := range []string{"SHA512", n.image} {
+		if n.cfg.DryRun {
+			fmt.Fprintf(n.cfg.out(), "\twould fetch %s\n", n.url(ver, file))
+			continue
+		}
+		if err := os.MkdirAll(outDir, 0750); err != nil {
+			return err
+		}
+		fp := path.Join(outDir, file)
+		if _, err := os.Stat(fp); err == nil && !n.cfg.Force && file != "SHA512" {
+			continue
+		}
+		slog.Info("fetching", "arch", n.arch, "file", file)
+		if err := n.download(ctx, n.url(ver, file), fp); err != nil {
+			return fmt.Errorf("fetch %s/%s: %w", n.arch, file, err)
+		}
+	}
+	return nil
+}
+
+func (n *NetBSD) download(ctx context.Context, u, fp string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := n.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{u, resp.Status, resp.StatusCode}
+	}
+
+	part := fp + ".part"
+	out, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	body := n.cfg.limited(ctx, resp.Body)
+	if n.cfg.Progress != nil {
+		body = &progress{
+			r:     body,
+			w:     n.cfg.Progress,
+			name:  path.Base(fp),
+			total: resp.ContentLength,
+			start: time.Now(),
+			last:  time.Now(),
+		}
+	}
+	if _, err := io.Copy(out, body); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part, fp)
+}
+
+var sha512Line = regexp.MustCompile(`^SHA512 \((.+)\) = ([0-9a-f]{128})$`)
+
+// Verify checks the image against SHA512. NetBSD doesn't sign its
+// checksums, so this only catches corrupt downloads.
+func (n *NetBSD) Verify(ctx context.Context, dest, ver, smushVer string) error {
+	if n.cfg.DryRun {
+		fmt.Fprintf(n.cfg.out(), "\twould verify %s against SHA512\n", n.image)
+		return nil
+	}
+
+	outDir := path.Join(dest, n.arch)
+	f, err := os.Open(path.Join(outDir, "SHA512"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	want := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if m := sha512Line.FindStringSubmatch(scanner.Text()); m != nil && m[1] == n.image {
+			want = m[2]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if want == "" {
+		return fmt.Errorf("verify %s/%s: not listed in SHA512: %w", n.arch, n.image, ErrChecksum)
+	}
+
+	slog.Info("verifying", "arch", n.arch, "file", n.image)
+	img, err := os.Open(path.Join(outDir, n.image))
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	h := sha512.New()
+	if _, err := io.Copy(h, img); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("verify %s/%s: %w: expected %s, got %s", n.arch, n.image, ErrChecksum, want, got)
+	}
+	return nil
+}
+
+// createDisk unpacks the image into the guest's disk, growing it to
+// -disk-size. The image grows its root file system to match on the
+// first boot.
+func (n *NetBSD) createDisk(ctx context.Context, outDir string) error {
+	raw := strings.TrimSuffix(n.image, ".gz")
+	if err := gunzip(path.Join(outDir, n.image), path.Join(outDir, raw)); err != nil {
+		return err
+	}
+	defer os.Remove(path.Join(outDir, raw))
+
+	diskFile := n.cfg.diskFile()
+	for _, c := range [][]string{
+		{"qemu-img", "convert", "-f", "raw", "-O", n.cfg.DiskFormat, raw, diskFile},
+		{"qemu-img", "resize", "-f", n.cfg.DiskFormat, diskFile, fmt.Sprintf("%dM", n.cfg.DiskSize)},
+	} {
+		if out, err := n.cfg.Runner.Run(ctx, outDir, c[0], c[1:]...); err != nil {
+			return fmt.Errorf("couldn't write %s to %s: %s: %s\n%s",
+				raw, diskFile, shellQuote(c), err, out)
+		}
+	}
+	return nil
+}
+
+func gunzip(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, zr); err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	return out.Close()
+}
+
+// Build boots a fresh copy of the image, adding the packages and
+// running the recipe in one boot, or boots an installed disk with
+// BaseImage, KeepDisk or Snapshot.
+func (n *NetBSD) Build(ctx context.Context, dest, ver, smushVer string) error {
+	outDir := path.Join(dest, n.arch)
+	disk := path.Join(outDir, n.cfg.diskFile())
+	if n.cfg.DryRun {
+		fmt.Fprintf(n.cfg.out(), "\twould run %s\n", shellQuote(n.cfg.qemuCmd(n.arch, n.qemu, n.bios, "", disk, n.cfg.DiskFormat)))
+		return nil
+	}
+
+	received, stop, err := n.prepare(outDir)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	switch _, err := os.Stat(disk); {
+	case n.cfg.BaseImage:
+		if _, err := os.Stat(path.Join(outDir, n.cfg.baseFile())); err != nil {
+			if err := n.install(ctx, outDir, ver); err != nil {
+				return err
+			}
+		}
+		return n.run(ctx, outDir, ver, received)
+	case err == nil && (n.cfg.KeepDisk || n.cfg.Snapshot):
+		return n.run(ctx, outDir, ver, received)
+	case n.cfg.Snapshot:
+		return fmt.Errorf("-snapshot needs an existing %s: %w", n.cfg.diskFile(), err)
+	}
+
+	if err := n.createDisk(ctx, outDir); err != nil {
+		return err
+	}
+	return n.boot(ctx, outDir, disk, n.cfg.DiskFormat, ver, false, received)
+}
+
+// Install boots a fresh copy of the image, or the base image with
+// BaseImage, and powers it off once the packages are added.
+func (n *NetBSD) Install(ctx context.Context, dest, ver, smushVer string) error {
+	outDir := path.Join(dest, n.arch)
+	if n.cfg.DryRun {
+		disk := path.Join(outDir, n.cfg.diskFile())
+		fmt.Fprintf(n.cfg.out(), "\twould run %s\n", shellQuote(n.cfg.qemuCmd(n.arch, n.qemu, n.bios, "", disk, n.cfg.DiskFormat)))
+		return nil
+	}
+
+	_, stop, err := n.prepare(outDir)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	return n.install(ctx, outDir, ver)
+}
+
+// Run boots the disk Install left and runs the recipe.
+func (n *NetBSD) Run(ctx context.Context, dest, ver, smushVer string) error {
+	outDir := path.Join(dest, n.arch)
+	if n.cfg.DryRun {
+		disk, format := path.Join(outDir, n.cfg.diskFile()), n.cfg.DiskFormat
+		if n.cfg.BaseImage {
+			disk, format = path.Join(outDir, overlayFile), "qcow2"
+		}
+		fmt.Fprintf(n.cfg.out(), "\twould run %s\n", shellQuote(n.cfg.qemuCmd(n.arch, n.qemu, n.bios, "", disk, format)))
+		return nil
+	}
+
+	received, stop, err := n.prepare(outDir)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	return n.run(ctx, outDir, ver, received)
+}
+
+// prepare starts the server the diff is uploaded to, returning the
+// channel the upload is signalled on and a function stopping it.
+func (n *NetBSD) prepare(outDir string) (chan error, func(), error) {
+	l, err := n.cfg.listen()
+	if err != nil {
+		return nil, nil, err
+	}
+	received := make(chan error, 1)
+	stop := n.cfg.serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		n.cfg.receiveDiff(w, r, outDir, n.arch, received)
+	}))
+
+	if err := removeStale(outDir, n.arch); err != nil {
+		stop()
+		return nil, nil, err
+	}
+
+	if n.bios != "" {
+		if _, err := os.Stat(n.bios); err != nil {
+			stop()
+			return nil, nil, fmt.Errorf("firmware for %s not found, set it with -%s-bios: %s",
+				n.arch, n.arch, err)
+		}
+	}
+	return received, stop, nil
+}
+
+// install adds the packages to a fresh copy of the image, which
+// becomes the base image with BaseImage.
+func (n *NetBSD) install(ctx context.Context, outDir, ver string) error {
+	disk := path.Join(outDir, n.cfg.diskFile())
+	if n.cfg.BaseImage {
+		slog.Info("installing", "arch", n.arch, "file", n.cfg.baseFile())
+	}
+	if err := n.createDisk(ctx, outDir); err != nil {
+		return err
+	}
+	if err := n.boot(ctx, outDir, disk, n.cfg.DiskFormat, ver, true, nil); err != nil {
+		return err
+	}
+	if n.cfg.BaseImage {
+		return os.Rename(disk, path.Join(outDir, n.cfg.baseFile()))
+	}
+	return nil
+}
+
+// run boots the installed disk and runs the recipe.
+func (n *NetBSD) run(ctx context.Context, outDir, ver string, received <-chan error) error {
+	disk, format, err := n.cfg.installedDisk(ctx, outDir)
+	if err != nil {
+		return err
+	}
+	return n.boot(ctx, outDir, disk, format, ver, false, received)
+}
+
+// boot runs the guest from disk, adding the packages and then either
+// powering off with installOnly or running the recipe and uploading
+// its diff to received.
+func (n *NetBSD) boot(ctx context.Context, outDir, disk, format, ver string, installOnly bool, received <-chan error) error {
+	qemuArgs := n.cfg.qemuCmd(n.arch, n.qemu, n.bios, "", disk, format)
+	if n.cfg.Verbose {
+		slog.Info("running qemu", "arch", n.arch, "cmd", shellQuote(qemuArgs))
+	}
+
+	prompt := regexp.QuoteMeta(netbsdPrompt)
+	pkgPath := fmt.Sprintf("https://cdn.netbsd.org/pub/pkgsrc/packages/NetBSD/%s/%s/All",
+		n.pkgArch, ver)
+	batch := []expect.Batcher{
+		&expect.BExpT{R: n.cfg.prompts().Login, T: int(n.cfg.BootTimeout.Seconds())},
+		&expect.BSnd{S: "root\n"},
+		&expect.BExp{R: "# $"},
+		// Quoted apart so the echoed command doesn't match.
+		&expect.BSnd{S: "PS1='goru''# '\n"},
+		&expect.BExp{R: prompt},
+	}
+	batch = append(batch, checked("packages",
+		fmt.Sprintf("env PKG_PATH=%s pkg_add %s curl", pkgPath, strings.Join(n.cfg.Packages, " ")),
+		prompt)...)
+	halt := []expect.Batcher{&expect.BSnd{S: "shutdown -p now\n"}}
+	if installOnly {
+		return n.cfg.runGuest(ctx, outDir, n.arch, qemuArgs,
+			[]phase{{name: "setup", batch: batch, timeout: stepWait, bootSteps: 1}}, halt, nil)
+	}
+	if n.cfg.Locale != "" {
+		batch = append(batch,
+			&expect.BSnd{S: fmt.Sprintf("export LC_ALL=%s\n", n.cfg.Locale)},
+			&expect.BExp{R: prompt},
+		)
+	}
+	data := recipeData{
+		Arch:   n.arch,
+		GOOS:   "netbsd",
+		GOARCH: archMap[n.arch],
+	}
+	steps, err := n.cfg.Recipe.steps(data, prompt)
+	if err != nil {
+		return err
+	}
+	capture, err := n.cfg.Recipe.capture(data)
+	if err != nil {
+		return err
+	}
+	batch = append(batch, steps...)
+	batch = append(batch, n.cfg.uploadSteps(capture, n.arch, prompt)...)
+
+	return n.cfg.runGuest(ctx, outDir, n.arch, qemuArgs,
+		[]phase{{name: "run", batch: batch, timeout: stepWait, bootSteps: 1}}, halt, awaitDiff(n.arch, received))
+}
@@ -0,0 +1,156 @@
+package goru
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+
+	expect "github.com/google/goexpect"
+	"google.golang.org/grpc/codes"
+)
+
+// Recipe describes the work done as the gopher user once the guest is
+// installed. Commands are templates rendered with recipeData.
+type Recipe struct {
+	// Repo is cloned into the home directory and Dir, relative to
+	// the home directory, is where the remaining commands run.
+	Repo string `json:"repo"`
+	Dir  string `json:"dir"`
+	// Ref, a branch, tag, commit or something like
+	// refs/pull/1/head, is checked out instead of the default
+	// branch when set.
+	Ref string `json:"ref"`
+
+	Setup    []string `json:"setup"`
+	Generate string   `json:"generate"`
+	Test     string   `json:"test"`
+	// Capture prints the artifact sent back to the host.
+	Capture string `json:"capture"`
+}
+
+type recipeData struct {
+	Arch   string // OpenBSD arch, arm64
+	GOOS   string // Go OS, openbsd
+	GOARCH string // Go arch, arm64
+}
+
+// SysRecipe regenerates golang.org/x/sys/unix.
+var SysRecipe = Recipe{
+	Repo:     "https://github.com/golang/sys",
+	Dir:      "sys/unix",
+	Generate: "env GOOS={{.GOOS}} GOARCH={{.GOARCH}} ./mkall.sh",
+	Test:     "env GOOS={{.GOOS}} GOARCH={{.GOARCH}} go test ./...",
+	Capture:  "git diff",
+}
+
+// LoadRecipe reads a JSON recipe.
+func LoadRecipe(file string) (Recipe, error) {
+	var r Recipe
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return r, fmt.Errorf("can't parse recipe %q: %w", file, err)
+	}
+	if r.Repo == "" || r.Generate == "" || r.Capture == "" {
+		return r, fmt.Errorf("recipe %q needs a repo, generate and capture command", file)
+	}
+	return r, nil
+}
+
+func (r Recipe) render(cmd string, data recipeData) (string, error) {
+	tmpl, err := template.New("recipe").Parse(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// steps returns the batch running the recipe up to the capture,
+// waiting for prompt after each command.
+func (r Recipe) steps(data recipeData, prompt string) ([]expect.Batcher, error) {
+	clone, err := r.render("git clone "+r.Repo, data)
+	if err != nil {
+		return nil, err
+	}
+	// A kept disk already has the clone from the last build, which
+	// is brought up to date and cleaned instead.
+	refresh := fmt.Sprintf("git -C %[1]s fetch && git -C %[1]s reset --hard FETCH_HEAD && git -C %[1]s clean -fdx",
+		r.cloneDir())
+	batch := checked("clone", fmt.Sprintf("if [ -d %s ]; then %s; else %s; fi",
+		r.cloneDir(), refresh, clone), prompt)
+	if r.Ref != "" {
+		batch = append(batch, checked("checkout",
+			fmt.Sprintf("git -C %s fetch origin %s && git -C %s checkout FETCH_HEAD",
+				r.cloneDir(), r.Ref, r.cloneDir()), prompt)...)
+	}
+
+	if r.Dir != "" {
+		batch = append(batch, checked("cd", "cd "+r.Dir, prompt)...)
+	}
+	for i, c := range r.Setup {
+		c, err := r.render(c, data)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, checked(fmt.Sprintf("setup %d", i+1), c, prompt)...)
+	}
+
+	// An empty capture only means nothing changed if these ran
+	// cleanly, so their exit status is checked.
+	for _, step := range []struct{ name, cmd string }{
+		{"generate", r.Generate},
+		{"test", r.Test},
+	} {
+		if step.cmd == "" {
+			continue
+		}
+		c, err := r.render(step.cmd, data)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, checked(step.name, c, prompt)...)
+	}
+
+	return batch, nil
+}
+
+// capture is the recipe's capture command for data.
+func (r Recipe) capture(data recipeData) (string, error) {
+	return r.render(r.Capture, data)
+}
+
+// cloneDir is the directory git clone puts Repo in.
+func (r Recipe) cloneDir() string {
+	return path.Base(strings.TrimSuffix(r.Repo, ".git"))
+}
+
+// checked runs cmd and fails the batch if it exits non-zero.
+func checked(name, cmd, prompt string) []expect.Batcher {
+	return []expect.Batcher{
+		&expect.BSnd{S: cmd + "; echo goru-status $?\n"},
+		&expect.BCas{C: []expect.Caser{
+			&expect.Case{
+				R: regexp.MustCompile(`goru-status 0\s`),
+				T: expect.OK(),
+			},
+			&expect.Case{
+				R: regexp.MustCompile(`goru-status [1-9]`),
+				T: expect.Fail(expect.NewStatus(codes.Aborted,
+					fmt.Sprintf("%s step failed in the guest", name))),
+			},
+		}},
+		&expect.BExp{R: prompt},
+	}
+}
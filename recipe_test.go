@@ -0,0 +1,155 @@
+package goru
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	expect "github.com/google/goexpect"
+)
+
+// runSteps runs the recipe's steps against a fake guest that answers
+// each command with its reply and the prompt. Checked commands without
+// a reply succeed.
+func runSteps(t *testing.T, r Recipe, replies map[string]string) error {
+	t.Helper()
+	const prompt = "buildlet$ "
+	steps, err := r.steps(recipeData{Arch: "amd64", GOARCH: "amd64"}, `buildlet\$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var guest []expect.Batcher
+	for _, s := range steps {
+		if s.Cmd() != expect.BatchSend {
+			continue
+		}
+		cmd := strings.TrimSuffix(s.Arg(), "\n")
+		reply, ok := replies[cmd]
+		if !ok && strings.HasSuffix(cmd, "; echo goru-status $?") {
+			reply = "goru-status 0\n"
+		}
+		guest = append(guest,
+			&expect.BExp{R: regexp.QuoteMeta(cmd)},
+			&expect.BSnd{S: reply + prompt},
+		)
+	}
+	// Each reply arrives with the prompt, so keep what follows a
+	// match for the next step.
+	e, _, err := expect.SpawnFake(guest, 5*time.Second, expect.PartialMatch(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	_, err = e.ExpectBatch(steps, 5*time.Second)
+	return err
+}
+
+func TestRecipeFailedStep(t *testing.T) {
+	r := Recipe{
+		Repo:     "https://example.org/repo",
+		Generate: "make generate",
+		Test:     "make test",
+		Capture:  "git diff",
+	}
+	for _, tc := range []struct {
+		name    string
+		replies map[string]string
+		failed  string // the step reported, none when empty
+	}{
+		{"success", map[string]string{
+			"make generate; echo goru-status $?": "goru-status 0\n",
+			"make test; echo goru-status $?":     "goru-status 0\n",
+		}, ""},
+		{"generate fails", map[string]string{
+			"make generate; echo goru-status $?": "mkall.sh: not found\ngoru-status 2\n",
+		}, "generate step failed"},
+		{"test fails", map[string]string{
+			"make generate; echo goru-status $?": "goru-status 0\n",
+			"make test; echo goru-status $?":     "FAIL\ngoru-status 1\n",
+		}, "test step failed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := runSteps(t, r, tc.replies)
+			switch {
+			case tc.failed == "" && err != nil:
+				t.Errorf("got %v, want no error", err)
+			case tc.failed != "" && (err == nil || !strings.Contains(err.Error(), tc.failed)):
+				t.Errorf("got %v, want %q", err, tc.failed)
+			}
+		})
+	}
+}
+
+// git runs git in dir for a test.
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=goru", "GIT_AUTHOR_EMAIL=goru@example.org",
+		"GIT_COMMITTER_NAME=goru", "GIT_COMMITTER_EMAIL=goru@example.org")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestRecipeRefreshesClone(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git")
+	}
+	repo := path.Join(t.TempDir(), "sys")
+	if err := os.Mkdir(repo, 0750); err != nil {
+		t.Fatal(err)
+	}
+	git(t, repo, "init", "-q")
+	if err := os.WriteFile(path.Join(repo, "zerrors.go"), []byte("old\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	git(t, repo, "add", ".")
+	git(t, repo, "commit", "-q", "-m", "old")
+
+	r := Recipe{Repo: repo}
+	steps, err := r.steps(recipeData{}, `\$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := strings.TrimSuffix(steps[0].Arg(), "; echo goru-status $?\n")
+	guest := t.TempDir()
+	run := func() {
+		t.Helper()
+		cmd := exec.Command("sh", "-c", clone)
+		cmd.Dir = guest
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s: %s\n%s", clone, err, out)
+		}
+	}
+	run()
+
+	// What the last build left behind on a kept disk, and a newer
+	// commit upstream.
+	dir := path.Join(guest, "sys")
+	for file, body := range map[string]string{"zerrors.go": "generated\n", "junk": "junk\n"} {
+		if err := os.WriteFile(path.Join(dir, file), []byte(body), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path.Join(repo, "zerrors.go"), []byte("new\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	git(t, repo, "commit", "-q", "-a", "-m", "new")
+	run()
+
+	if got, want := git(t, dir, "rev-parse", "HEAD"), git(t, repo, "rev-parse", "HEAD"); got != want {
+		t.Errorf("clone is at %s, want %s", got, want)
+	}
+	if st := git(t, dir, "status", "--porcelain", "--ignored"); st != "" {
+		t.Errorf("clone isn't clean:\n%s", st)
+	}
+}
@@ -0,0 +1,171 @@
+package goru
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// CombinedDiff is the file in the release's directory WriteCombined
+// puts every arch's diff in.
+const CombinedDiff = "combined.diff"
+
+// Result records how far an arch got in a run.
+type Result struct {
+	Arch     string  `json:"arch"`
+	Stage    string  `json:"stage"`
+	Error    string  `json:"error,omitempty"`
+	Seconds  float64 `json:"seconds"`
+	DiffSize int64   `json:"diff_size"`
+	// Diff is unset when the arch has no diff.
+	Diff *DiffStat `json:"diff,omitempty"`
+}
+
+// DiffStat sums up the changes in a unified diff.
+type DiffStat struct {
+	Files      int `json:"files"`
+	Insertions int `json:"insertions"`
+	Deletions  int `json:"deletions"`
+	// Empty diffs are worth a second look, they're also what a
+	// recipe that quietly didn't regenerate anything produces.
+	Empty bool `json:"empty"`
+}
+
+func (d DiffStat) String() string {
+	if d.Empty {
+		return "empty"
+	}
+	files := "files"
+	if d.Files == 1 {
+		files = "file"
+	}
+	return fmt.Sprintf("%d %s changed, +%d/-%d", d.Files, files, d.Insertions, d.Deletions)
+}
+
+// hunkRE matches a hunk header, capturing its old and new line counts.
+var hunkRE = regexp.MustCompile(`^@@ -\d+(?:,(\d+))? \+\d+(?:,(\d+))? @@`)
+
+// ParseDiffStat counts the files and lines a unified diff changes.
+func ParseDiffStat(diff []byte) DiffStat {
+	var st DiffStat
+	gitFiles, plainFiles := 0, 0
+	oldLeft, newLeft := 0, 0
+	for _, line := range strings.Split(string(diff), "\n") {
+		if oldLeft > 0 || newLeft > 0 {
+			switch {
+			case strings.HasPrefix(line, "+"):
+				st.Insertions++
+				newLeft--
+			case strings.HasPrefix(line, "-"):
+				st.Deletions++
+				oldLeft--
+			case strings.HasPrefix(line, `\`):
+				// No newline at end of file.
+			default:
+				oldLeft--
+				newLeft--
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			gitFiles++
+		case strings.HasPrefix(line, "+++ "):
+			plainFiles++
+		case strings.HasPrefix(line, "@@ "):
+			if m := hunkRE.FindStringSubmatch(line); m != nil {
+				oldLeft, newLeft = hunkLines(m[1]), hunkLines(m[2])
+			}
+		}
+	}
+	// Renames and binary files don't get +++ lines in git's diffs.
+	st.Files = max(gitFiles, plainFiles)
+	st.Empty = st.Files == 0
+	return st
+}
+
+// hunkLines is a hunk header's line count, which is 1 when left out.
+func hunkLines(s string) int {
+	if s == "" {
+		return 1
+	}
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func (r Result) OK() bool {
+	return r.Error == ""
+}
+
+// Results are the outcome of each arch in a run.
+type Results []Result
+
+func (rs Results) Failed() bool {
+	for _, r := range rs {
+		if !r.OK() {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs Results) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ARCH\tSTAGE\tDURATION\tDIFF\tCHANGES\tERROR")
+	for _, r := range rs {
+		d := time.Duration(r.Seconds * float64(time.Second)).Round(time.Second)
+		changes := "-"
+		if r.Diff != nil {
+			changes = r.Diff.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", r.Arch, r.Stage, d, r.DiffSize, changes, r.Error)
+	}
+	return tw.Flush()
+}
+
+func (rs Results) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rs)
+}
+
+// WriteCombined puts the diffs of the arches that succeeded together
+// in CombinedDiff in dest, each under a header naming the arch, and
+// returns the arches included. Failed arches and empty diffs are left
+// out, and with nothing to include no file is written.
+func (rs Results) WriteCombined(dest string) ([]string, error) {
+	var buf bytes.Buffer
+	var arches []string
+	for _, r := range rs {
+		if !r.OK() || r.DiffSize == 0 {
+			continue
+		}
+		diff, err := os.ReadFile(path.Join(dest, r.Arch, DiffName(r.Arch)))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "# goru: %s (%s)\n", r.Arch, DiffName(r.Arch))
+		buf.Write(diff)
+		if !bytes.HasSuffix(diff, []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		arches = append(arches, r.Arch)
+	}
+	fp := path.Join(dest, CombinedDiff)
+	if len(arches) == 0 {
+		// Don't leave an older run's behind looking current.
+		if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return arches, os.WriteFile(fp, buf.Bytes(), 0640)
+}
@@ -0,0 +1,70 @@
+package goru
+
+import "testing"
+
+func TestParseDiffStat(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		diff string
+		want DiffStat
+	}{
+		{"empty", "", DiffStat{Empty: true}},
+		{"git", `diff --git a/zerrors_openbsd_amd64.go b/zerrors_openbsd_amd64.go
+index 1111111..2222222 100644
+--- a/zerrors_openbsd_amd64.go
++++ b/zerrors_openbsd_amd64.go
+@@ -10,3 +10,4 @@ const (
+ 	EINVAL = 0x16
+--- a removed line that looks like a header
++++ an added line that looks like a header
++	ENOTSUP = 0x5b
+ 	EPERM = 0x1
+diff --git a/ztypes_openbsd_amd64.go b/ztypes_openbsd_amd64.go
+index 3333333..4444444 100644
+--- a/ztypes_openbsd_amd64.go
++++ b/ztypes_openbsd_amd64.go
+@@ -1 +1 @@
+-const sizeofPtr = 0x4
+\ No newline at end of file
++const sizeofPtr = 0x8
+\ No newline at end of file
+`, DiffStat{Files: 2, Insertions: 3, Deletions: 2}},
+		{"rename and binary", `diff --git a/old.go b/new.go
+similarity index 100%
+rename from old.go
+rename to new.go
+diff --git a/logo.png b/logo.png
+index 5555555..6666666 100644
+Binary files a/logo.png and b/logo.png differ
+`, DiffStat{Files: 2}},
+		{"plain", `--- syscall.h.orig
++++ syscall.h
+@@ -1,3 +1,2 @@
+ #define SYS_exit 1
+-#define SYS_fork 2
+-#define SYS_read 3
++#define SYS_read 3
+`, DiffStat{Files: 1, Insertions: 1, Deletions: 2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ParseDiffStat([]byte(tc.diff)); got != tc.want {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiffStatString(t *testing.T) {
+	for _, tc := range []struct {
+		st   DiffStat
+		want string
+	}{
+		{DiffStat{Empty: true}, "empty"},
+		{DiffStat{Files: 1, Insertions: 2}, "1 file changed, +2/-0"},
+		{DiffStat{Files: 3, Insertions: 10, Deletions: 4}, "3 files changed, +10/-4"},
+	} {
+		if got := tc.st.String(); got != tc.want {
+			t.Errorf("%+v: got %q, want %q", tc.st, got, tc.want)
+		}
+	}
+}
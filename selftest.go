@@ -0,0 +1,121 @@
+package goru
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// selfTestDiff is posted to the handler to check the upload path.
+const selfTestDiff = `--- a/unix/zerrors_openbsd_amd64.go
++++ b/unix/zerrors_openbsd_amd64.go
+@@ -1 +1 @@
+-// selftest
++// selftest ok
+`
+
+// SelfTest checks the host tools and runs the http handler through
+// the same requests the guest makes, without installing anything.
+func SelfTest(sets Sets) error {
+	slog.Info("checking for required tools")
+	if missing := MissingTools(sets.RequiredTools()); len(missing) > 0 {
+		return fmt.Errorf("missing required tools: %s", strings.Join(missing, ", "))
+	}
+
+	outDir, err := os.MkdirTemp("", "goru-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(outDir)
+
+	o, ok := sets[0].(*OpenBSD)
+	if !ok {
+		return errors.New("the self test only knows how to run OpenBSD")
+	}
+	instConf, err := o.responseFile()
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	received := make(chan error, 1)
+	ser := &http.Server{Handler: o.cfg.requireToken(o.handler(outDir, instConf, received))}
+	go ser.Serve(l)
+	defer ser.Close()
+
+	base := fmt.Sprintf("http://%s", l.Addr())
+	slog.Info("serving", "url", base)
+
+	if o.cfg.Token != "" {
+		slog.Info("fetching without the token", "file", "/install.conf")
+		resp, err := o.cfg.Client.Get(base + "/install.conf")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			return fmt.Errorf("request without the token got %s", resp.Status)
+		}
+		base += o.cfg.prefix()
+	}
+
+	for file, want := range map[string]string{
+		"/install.conf": instConf,
+		"/disklabel":    o.cfg.DiskLayout,
+	} {
+		slog.Info("fetching", "file", file)
+		resp, err := o.cfg.Client.Get(base + file)
+		if err != nil {
+			return err
+		}
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if string(got) != want {
+			return fmt.Errorf("%s: unexpected contents:\n%s", file, got)
+		}
+	}
+
+	slog.Info("posting diff")
+	enc := base64.StdEncoding.EncodeToString([]byte(selfTestDiff))
+	resp, err := o.cfg.Client.Post(base+"/?arch="+o.arch, "application/x-www-form-urlencoded",
+		strings.NewReader(enc))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("diff upload failed: %s", resp.Status)
+	}
+	select {
+	case err := <-received:
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("diff upload wasn't signalled")
+	}
+
+	diff, err := os.ReadFile(path.Join(outDir, DiffName(o.arch)))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(diff, []byte(selfTestDiff)) {
+		return fmt.Errorf("uploaded diff doesn't match:\n%s", diff)
+	}
+
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !openbsd
+
+package goru
+
+import "errors"
+
+// freeSpace isn't known here, so the space checks are skipped.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,110 @@
+package goru
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ParseSSHKey checks b holds a single public key in authorized_keys
+// format and returns it as one line, without options, for the
+// installer to add for the guest user.
+func ParseSSHKey(b []byte) (string, error) {
+	pub, comment, _, rest, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return "", fmt.Errorf("can't parse ssh key: %w", err)
+	}
+	if strings.TrimSpace(string(rest)) != "" {
+		return "", fmt.Errorf("more than one ssh key given")
+	}
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	// The comment ends up in the response file, where only a line
+	// of printable characters is safe.
+	if comment != "" && strings.IndexFunc(comment, func(r rune) bool { return r < ' ' || r > '~' }) < 0 {
+		key += " " + comment
+	}
+	return key, nil
+}
+
+// sshDiff returns a runGuest collect function running capture in the
+// guest as the guest user, over the -ssh-port forward, and saving its
+// output as the arch's diff.
+func (c *Config) sshDiff(outDir, arch, capture string) func(context.Context) error {
+	return func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, diffWait)
+		defer cancel()
+
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(c.SSHPort))
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return fmt.Errorf("can't reach the %s guest's sshd: %w", arch, err)
+		}
+		// Closing the connection is the only way to interrupt the
+		// handshake or the command.
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		defer stop()
+		defer conn.Close()
+
+		sc, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+			User: c.Guest.User,
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(c.SSHSigner)},
+			// The host keys were made by this install and the
+			// guest is only reachable through the forward.
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return fmt.Errorf("can't log in to the %s guest over ssh: %w", arch, err)
+		}
+		client := ssh.NewClient(sc, chans, reqs)
+		defer client.Close()
+
+		sess, err := client.NewSession()
+		if err != nil {
+			return err
+		}
+		defer sess.Close()
+
+		cmd := capture
+		if c.Recipe.Dir != "" {
+			cmd = fmt.Sprintf("cd %s && %s", c.Recipe.Dir, capture)
+		}
+		var stderr bytes.Buffer
+		sess.Stderr = &stderr
+		diff, err := sess.Output(cmd)
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("no diff from the %s guest after %s", arch, diffWait)
+			}
+			return fmt.Errorf("capture failed in the %s guest: %w\n%s", arch, err, stderr.Bytes())
+		}
+		return c.saveDiff(outDir, arch, diff)
+	}
+}
+
+// LoadSSHSigner reads the private key in file, which has to be the
+// one for the authorized key line pub.
+func LoadSSHSigner(file, pub string) (ssh.Signer, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("can't use ssh key %q: %w", file, err)
+	}
+	want, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pub))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(signer.PublicKey().Marshal(), want.Marshal()) {
+		return nil, fmt.Errorf("ssh key %q doesn't match its public key", file)
+	}
+	return signer, nil
+}